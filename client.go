@@ -1,71 +1,1007 @@
-package main
-
-import (
-	"context"
-	"crypto/tls"
-	"fmt"
-	"io"
-	"log"
-	"time"
-
-	"github.com/quic-go/quic-go"
-)
-
-func main() {
-	fmt.Println("🔌 Connecting to QUIC server...")
-
-	// Configure TLS to accept self-signed certificates (for testing only!)
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"quic-learning-lab"},
-	}
-
-	// Connect to the server
-	conn, err := quic.DialAddr(context.Background(), "localhost:4242", tlsConf, nil)
-	if err != nil {
-		log.Fatal("Failed to connect:", err)
-	}
-	defer conn.CloseWithError(0, "client done")
-
-	fmt.Printf("✅ Connected to %s\n", conn.RemoteAddr())
-
-	// Demonstrate multiple streams
-	for i := 1; i <= 3; i++ {
-		fmt.Printf("\n🔄 Creating stream %d...\n", i)
-		
-		// Open a new stream
-		stream, err := conn.OpenStreamSync(context.Background())
-		if err != nil {
-			log.Fatal("Failed to open stream:", err)
-		}
-
-		// Send a message
-		message := fmt.Sprintf("Hello from stream %d! Time: %v", i, time.Now().Format("15:04:05"))
-		fmt.Printf("📤 Sending: %s\n", message)
-		
-		_, err = stream.Write([]byte(message))
-		if err != nil {
-			log.Fatal("Failed to send message:", err)
-		}
-
-		// Close the write side to signal we're done sending
-		stream.Close()
-
-		// Read the response
-		buffer := make([]byte, 1024)
-		n, err := stream.Read(buffer)
-		if err != nil && err != io.EOF {
-			log.Fatal("Failed to read response:", err)
-		}
-
-		if n > 0 {
-			response := string(buffer[:n])
-			fmt.Printf("📨 Received: %s\n", response)
-		}
-		
-		// Wait a bit between streams to see the multiplexing
-		time.Sleep(1 * time.Second)
-	}
-
-	fmt.Println("\n🎉 All streams completed!")
-}
\ No newline at end of file
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// alpnProtocol is the application protocol the server speaks, and
+// alpnCompressed the same protocol with every stream deflated, for -compress
+const (
+	alpnProtocol   = "quic-learning-lab"
+	alpnCompressed = "quic-learning-lab+deflate"
+)
+
+// Reasons sent to the server when the client closes a connection
+const (
+	closeReasonDone = "client done"
+)
+
+// errorCodeNoALPN is the TLS no_application_protocol alert as a QUIC error
+// code, sent by a server that speaks none of the protocols we offered
+const errorCodeNoALPN = quic.TransportErrorCode(0x100 + 120)
+
+// Stream error codes the server resets a stream with when it was too
+// slow or busy to answer, rather than unhappy with the request itself
+const (
+	errorCodeHandlerTimeout quic.StreamErrorCode = 0x2
+	errorCodeSingleStream   quic.StreamErrorCode = 0x5
+)
+
+var (
+	closeReason  = flag.String("close-reason", closeReasonDone, "reason sent to the server when closing the connection")
+	serverAddr   = flag.String("addr", "localhost:4242", "server address to connect to")
+	quicVersions = flag.String("versions", "v1,v2", "comma-separated QUIC versions to offer; the first is used for the initial packet")
+	scatterAddrs = flag.String("scatter", "", "comma-separated server addresses; send -message to all of them and compare the responses")
+	message      = flag.String("message", "Hello from the scatter client!", "message sent to every server in -scatter mode")
+	packetSize   = flag.Uint("initial-packet-size", 0, "initial UDP payload size in bytes (0 uses the quic-go default of 1280)")
+	disablePMTUD = flag.Bool("disable-mtu-discovery", false, "never grow packets beyond -initial-packet-size")
+
+	dialAttempts     = flag.Int("dial-attempts", 1, "how many times to try connecting to a server")
+	dialRetryDelay   = flag.Duration("dial-retry-delay", time.Second, "pause between connection attempts")
+	breakerThreshold = flag.Int("breaker-threshold", 3, "consecutive failed connection attempts that open a server's circuit breaker (0 disables)")
+	breakerCooldown  = flag.Duration("breaker-cooldown", 5*time.Second, "how long an open circuit fails fast before letting a probe through")
+	streamAttempts   = flag.Int("stream-attempts", 1, "how many streams to try each echo on before giving up, when the server resets them for being slow or busy")
+	streamRetryDelay = flag.Duration("stream-retry-delay", 100*time.Millisecond, "pause before the first stream retry, doubling after each")
+	datagrams        = flag.Int("datagrams", 0, "send this many numbered datagrams instead of the stream demo and report how many the server acknowledged")
+	datagramInterval = flag.Duration("datagram-interval", 10*time.Millisecond, "pause between datagrams")
+	datagramTimeout  = flag.Duration("datagram-ack-timeout", time.Second, "how long a datagram may go unacknowledged before it counts as lost")
+	warmup           = flag.Bool("warmup", false, "send a small ping right after connecting so the first real request doesn't pay for the rest of the handshake")
+	appPing          = flag.Duration("app-ping", 0, "echo a ping whenever the connection has carried no request for this long, to keep a server's -app-idle-timeout from closing it (0 disables)")
+	numberLines      = flag.Bool("number-lines", false, "for a server started with -number-lines: send the demo messages as lines of one stream and read each numbered line back as it arrives")
+	compress         = flag.Bool("compress", false, "offer to deflate all stream data; a server started with -compress agrees")
+	proxyAddr        = flag.String("proxy", "", "HTTP proxy (host:port) supporting connect-udp to tunnel QUIC through")
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// breakers holds one circuit breaker per server address
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker)
+)
+
+// clientCerts holds every -cert given on the command line
+var clientCerts certList
+
+func main() {
+	flag.Var(&clientCerts, "cert", "client certificate as certfile,keyfile; repeat to load several")
+	flag.Parse()
+
+	versions, err := parseVersions(*quicVersions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	certs, err := clientCerts.load()
+	if err != nil {
+		log.Fatal("Failed to load client certificate:", err)
+	}
+
+	// Configure TLS to accept self-signed certificates (for testing only!)
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpnProtocol},
+	}
+	if *compress {
+		// A server speaking both prefers compression, so this one only gets it when it asked
+		tlsConf.NextProtos = []string{alpnCompressed, alpnProtocol}
+	}
+	if len(certs) > 0 {
+		tlsConf.GetClientCertificate = selectClientCertificate(certs)
+	}
+
+	quicConf := &quic.Config{
+		Versions:                versions,
+		InitialPacketSize:       uint16(*packetSize),
+		DisablePathMTUDiscovery: *disablePMTUD,
+		EnableDatagrams:         *datagrams > 0,
+		Tracer:                  newConnectionTracer,
+	}
+
+	if flag.Arg(0) == "probe" {
+		report, err := probe(context.Background(), *serverAddr, tlsConf, quicConf)
+		if err != nil {
+			log.Fatal("Probe failed:", err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	if *scatterAddrs != "" {
+		if !scatter(strings.Split(*scatterAddrs, ","), *message, tlsConf, quicConf) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Println("🔌 Connecting to QUIC server...")
+
+	// Connect to the server
+	conn, err := dial(context.Background(), *serverAddr, tlsConf, quicConf)
+	if err != nil {
+		log.Fatal("Failed to connect:", err)
+	}
+	defer conn.CloseWithError(0, *closeReason)
+
+	fmt.Printf("✅ Connected to %s\n", conn.RemoteAddr())
+	if *compress {
+		if conn.ConnectionState().TLS.NegotiatedProtocol == alpnCompressed {
+			fmt.Println("🗜️  Server agreed to compress all stream data")
+		} else {
+			fmt.Println("🗜️  Server doesn't compress (start it with -compress), sending stream data as is")
+		}
+	}
+
+	if *datagrams > 0 {
+		if !conn.ConnectionState().SupportsDatagrams {
+			log.Fatal("The server doesn't accept datagrams, start it with -datagram-ack")
+		}
+		sendDatagrams(conn, *datagrams, *datagramInterval, *datagramTimeout)
+		return
+	}
+
+	if *warmup {
+		warmupConnection(context.Background(), conn)
+	}
+
+	var lastRequest atomic.Int64
+	lastRequest.Store(time.Now().UnixNano())
+	if *appPing > 0 {
+		go keepAppAlive(conn, *appPing, &lastRequest)
+	}
+
+	if *numberLines {
+		var messages []string
+		for i := 1; i <= 3; i++ {
+			messages = append(messages, fmt.Sprintf("Hello from line %d! Time: %v", i, time.Now().Format("15:04:05")))
+		}
+		if err := echoLines(context.Background(), conn, messages); err != nil {
+			logPeerClose(err)
+			log.Fatal("Stream failed:", err)
+		}
+		fmt.Println("\n🎉 All lines numbered!")
+		return
+	}
+
+	// Demonstrate multiple streams
+	for i := 1; i <= 3; i++ {
+		fmt.Printf("\n🔄 Creating stream %d...\n", i)
+
+		// Send a message on a new stream
+		message := fmt.Sprintf("Hello from stream %d! Time: %v", i, time.Now().Format("15:04:05"))
+		fmt.Printf("📤 Sending: %s\n", message)
+
+		result := echoWithRetry(context.Background(), conn, message)
+		lastRequest.Store(time.Now().UnixNano())
+		if result.Err != nil {
+			logPeerClose(result.Err)
+			log.Fatal("Stream failed:", result.Err)
+		}
+		printResult(result)
+
+		// Wait a bit between streams to see the multiplexing
+		time.Sleep(1 * time.Second)
+	}
+
+	fmt.Println("\n🎉 All streams completed!")
+}
+
+// sendDatagrams sends count datagrams, interval apart, each starting with
+// its sequence number, and returns how many the server acknowledged. Unlike
+// stream data a datagram is never retransmitted, so one that isn't
+// acknowledged within timeout is reported as lost; either it or its
+// acknowledgment didn't make it.
+func sendDatagrams(conn *quic.Conn, count int, interval, timeout time.Duration) int {
+	var (
+		mu       sync.Mutex
+		sentAt   = make(map[uint64]time.Time, count)
+		acked    int
+		totalRTT time.Duration
+	)
+	ctx, cancel := context.WithCancel(conn.Context())
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for {
+			ack, err := conn.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			if len(ack) != 8 {
+				continue
+			}
+			seq := binary.BigEndian.Uint64(ack)
+			mu.Lock()
+			if sent, ok := sentAt[seq]; ok && time.Since(sent) <= timeout {
+				acked++
+				totalRTT += time.Since(sent)
+				delete(sentAt, seq)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	fmt.Printf("📮 Sending %d datagrams, %v apart...\n", count, interval)
+	for seq := uint64(1); seq <= uint64(count); seq++ {
+		payload := binary.BigEndian.AppendUint64(nil, seq)
+		payload = fmt.Appendf(payload, " datagram %d", seq)
+		mu.Lock()
+		sentAt[seq] = time.Now()
+		mu.Unlock()
+		if err := conn.SendDatagram(payload); err != nil {
+			fmt.Printf("❌ Datagram %d not sent: %v\n", seq, err)
+		}
+		time.Sleep(interval)
+	}
+
+	// Give the last datagrams their full timeout, but stop early once
+	// everything is accounted for
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		pending := len(sentAt)
+		mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-received
+
+	lost := count - acked
+	fmt.Printf("📊 %d of %d datagrams acknowledged", acked, count)
+	if acked > 0 {
+		fmt.Printf(" (average round trip %v)", totalRTT/time.Duration(acked))
+	}
+	fmt.Printf(", %d lost (%.1f%%)\n", lost, 100*float64(lost)/float64(count))
+	return acked
+}
+
+// warmupConnection does a throwaway echo before the real requests. A dial
+// returns as soon as the client can send, but the server only confirms the
+// handshake (HANDSHAKE_DONE) and tunes the connection a round trip later,
+// and this ping pays for that instead of the first request.
+func warmupConnection(ctx context.Context, conn *quic.Conn) {
+	result := echo(ctx, conn, "ping")
+	if result.Err != nil {
+		fmt.Printf("⚠️  Warmup ping failed: %v\n", result.Err)
+		return
+	}
+	fmt.Printf("🔥 Warmup ping took %v\n", result.Duration)
+}
+
+// keepAppAlive echoes a ping whenever no request has gone out on the
+// connection for interval, measured from lastRequest (Unix nanoseconds),
+// until the connection closes. QUIC keep-alives wouldn't help: they keep
+// the connection alive, not the server application's idle timer, which
+// only counts streams.
+func keepAppAlive(conn *quic.Conn, interval time.Duration, lastRequest *atomic.Int64) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-timer.C:
+		}
+		if idle := time.Since(time.Unix(0, lastRequest.Load())); idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+		result := echo(conn.Context(), conn, "ping")
+		lastRequest.Store(time.Now().UnixNano())
+		if result.Err != nil {
+			if conn.Context().Err() != nil {
+				return
+			}
+			fmt.Printf("⚠️  App ping failed: %v\n", result.Err)
+		} else {
+			fmt.Printf("🏓 App ping took %v\n", result.Duration)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// scatter sends the same message to every server concurrently, each over its
+// own connection, and reports whether all of them answered identically.
+func scatter(addrs []string, message string, tlsConf *tls.Config, quicConf *quic.Config) bool {
+	fmt.Printf("📡 Scattering %q to %d servers...\n", message, len(addrs))
+	results := make([]Result, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = echoOnce(addr, message, tlsConf, quicConf)
+		}()
+	}
+	wg.Wait()
+
+	agree := true
+	for i, r := range results {
+		if r.Err != nil {
+			fmt.Printf("❌ %s: %v\n", addrs[i], r.Err)
+			logPeerClose(r.Err)
+			agree = false
+			continue
+		}
+		fmt.Printf("📨 %s: %s (%v)\n", addrs[i], r.Response, r.Duration)
+		if !bytes.Equal(r.Response, results[0].Response) {
+			agree = false
+		}
+	}
+
+	if agree {
+		fmt.Printf("✅ All %d servers agree\n", len(addrs))
+	} else {
+		fmt.Println("⚠️  Servers disagree or failed")
+	}
+	return agree
+}
+
+// probeReport is what the probe subcommand found out about a server
+type probeReport struct {
+	Address          string          `json:"address"`
+	QUICVersion      string          `json:"quic_version"`
+	ALPN             string          `json:"alpn"`
+	TLSVersion       string          `json:"tls_version"`
+	CipherSuite      string          `json:"cipher_suite"`
+	HandshakeTime    string          `json:"handshake_time"`
+	Datagrams        bool            `json:"datagrams"`
+	ReliableReset    bool            `json:"reliable_reset"`
+	Resumption       bool            `json:"session_resumption"`
+	ZeroRTT          bool            `json:"zero_rtt"`
+	EchoWorks        bool            `json:"echo"`
+	TransportParams  transportReport `json:"transport_parameters"`
+	ResumptionDetail string          `json:"resumption_detail,omitempty"`
+}
+
+// transportReport holds the server's transport parameters that matter to a
+// client: how much it may open and send, and how the connection may behave
+type transportReport struct {
+	MaxBidiStreams          int64  `json:"max_bidi_streams"`
+	MaxUniStreams           int64  `json:"max_uni_streams"`
+	InitialMaxData          int64  `json:"initial_max_data"`
+	InitialMaxStreamData    int64  `json:"initial_max_stream_data"`
+	MaxIdleTimeout          string `json:"max_idle_timeout"`
+	MaxUDPPayloadSize       int64  `json:"max_udp_payload_size"`
+	MaxDatagramFrameSize    int64  `json:"max_datagram_frame_size"`
+	ActiveConnectionIDLimit uint64 `json:"active_connection_id_limit"`
+	DisableActiveMigration  bool   `json:"disable_active_migration"`
+}
+
+// probe connects to addr and reports what the server supports. It exchanges
+// one echo on the first connection, then reconnects with the session ticket
+// it got to find out whether the server allows resumption and 0-RTT.
+func probe(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*probeReport, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	quicConf = quicConf.Clone()
+	quicConf.EnableDatagrams = true
+
+	// Capture the server's transport parameters instead of logging them
+	params := make(chan transportReport, 1)
+	quicConf.Tracer = func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+		return &logging.ConnectionTracer{
+			ReceivedTransportParameters: func(p *logging.TransportParameters) {
+				report := transportReport{
+					MaxBidiStreams:          int64(p.MaxBidiStreamNum),
+					MaxUniStreams:           int64(p.MaxUniStreamNum),
+					InitialMaxData:          int64(p.InitialMaxData),
+					InitialMaxStreamData:    int64(p.InitialMaxStreamDataBidiRemote),
+					MaxIdleTimeout:          p.MaxIdleTimeout.String(),
+					MaxUDPPayloadSize:       int64(p.MaxUDPPayloadSize),
+					MaxDatagramFrameSize:    max(int64(p.MaxDatagramFrameSize), 0), // -1 when not advertised
+					ActiveConnectionIDLimit: p.ActiveConnectionIDLimit,
+					DisableActiveMigration:  p.DisableActiveMigration,
+				}
+				// Only the first connection's parameters are reported
+				select {
+				case params <- report:
+				default:
+				}
+			},
+		}
+	}
+
+	start := time.Now()
+	conn, err := dial(ctx, addr, tlsConf, quicConf)
+	if err != nil {
+		return nil, err
+	}
+	state := conn.ConnectionState()
+	report := &probeReport{
+		Address:       conn.RemoteAddr().String(),
+		QUICVersion:   state.Version.String(),
+		ALPN:          state.TLS.NegotiatedProtocol,
+		TLSVersion:    tls.VersionName(state.TLS.Version),
+		CipherSuite:   tls.CipherSuiteName(state.TLS.CipherSuite),
+		HandshakeTime: time.Since(start).String(),
+		Datagrams:     state.SupportsDatagrams,
+		ReliableReset: state.SupportsStreamResetPartialDelivery,
+	}
+
+	// Transport parameters arrive during the handshake, so they're in by now
+	select {
+	case report.TransportParams = <-params:
+	default:
+	}
+
+	// The round trip also gives the session ticket time to arrive
+	result := echo(ctx, conn, "probe")
+	report.EchoWorks = result.Err == nil
+	conn.CloseWithError(0, *closeReason)
+
+	// Through the same proxy and circuit breaker as the first connection
+	early, err := dialEarly(ctx, addr, tlsConf, quicConf)
+	if err != nil {
+		report.ResumptionDetail = fmt.Sprintf("reconnecting failed: %v", err)
+		return report, nil
+	}
+	defer early.CloseWithError(0, *closeReason)
+	select {
+	case <-early.HandshakeComplete():
+	case <-early.Context().Done():
+		report.ResumptionDetail = fmt.Sprintf("reconnecting failed: %v", context.Cause(early.Context()))
+		return report, nil
+	}
+	resumed := early.ConnectionState()
+	report.Resumption = resumed.TLS.DidResume
+	report.ZeroRTT = resumed.Used0RTT
+	return report, nil
+}
+
+// dial connects to addr, retrying up to -dial-attempts times. Every attempt
+// goes through the server's circuit breaker, so a server that keeps failing
+// is skipped without waiting for another handshake timeout.
+func dial(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+	return dialWith(ctx, addr, tlsConf, quicConf, false)
+}
+
+// dialEarly is dial for a connection that may send 0-RTT data: it returns
+// before the handshake has completed, as quic.DialAddrEarly does
+func dialEarly(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+	return dialWith(ctx, addr, tlsConf, quicConf, true)
+}
+
+func dialWith(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config, early bool) (*quic.Conn, error) {
+	breaker := breakerFor(addr)
+	var err error
+	for attempt := 1; attempt <= *dialAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(*dialRetryDelay)
+		}
+		if err = breaker.Allow(); err != nil {
+			fmt.Printf("⚡ Attempt %d to %s failed fast: %v\n", attempt, addr, err)
+			continue
+		}
+		var conn *quic.Conn
+		if *proxyAddr != "" {
+			conn, err = dialThroughProxy(ctx, *proxyAddr, addr, tlsConf, quicConf, early)
+		} else if early {
+			conn, err = quic.DialAddrEarly(ctx, addr, tlsConf, quicConf)
+		} else {
+			conn, err = quic.DialAddr(ctx, addr, tlsConf, quicConf)
+		}
+		breaker.Record(addr, err)
+		if err == nil {
+			return conn, nil
+		}
+		fmt.Printf("❌ Attempt %d to %s failed: %v\n", attempt, addr, err)
+		// Retrying can't help if the server doesn't speak our protocol
+		var transportErr *quic.TransportError
+		if errors.As(err, &transportErr) && transportErr.Remote && transportErr.ErrorCode == errorCodeNoALPN {
+			fmt.Printf("🔤 %s speaks none of the application protocols we offered: %q\n", addr, tlsConf.NextProtos)
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// dialThroughProxy connects to addr with every QUIC packet tunneled through
+// an HTTP proxy, for servers that can only be reached that way
+func dialThroughProxy(ctx context.Context, proxy, addr string, tlsConf *tls.Config, quicConf *quic.Config, early bool) (*quic.Conn, error) {
+	tunnel, err := openUDPTunnel(ctx, proxy, addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxy, err)
+	}
+	fmt.Printf("🚇 Tunneling to %s through proxy %s\n", addr, proxy)
+
+	// quic.DialAddr takes the server name from the address, but
+	// Transport.Dial leaves it empty, and TLS then neither sends SNI nor
+	// caches the session ticket for resumption
+	if tlsConf.ServerName == "" {
+		tlsConf = tlsConf.Clone()
+		tlsConf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	transport := &quic.Transport{Conn: tunnel}
+	dial := transport.Dial
+	if early {
+		dial = transport.DialEarly
+	}
+	conn, err := dial(ctx, tunnel.target, tlsConf, quicConf)
+	if err != nil {
+		tunnel.Close()
+		transport.Close()
+		return nil, err
+	}
+	// The tunnel belongs to this connection alone
+	context.AfterFunc(conn.Context(), func() {
+		tunnel.Close()
+		transport.Close()
+	})
+	return conn, nil
+}
+
+// udpTunnel carries UDP payloads to a single target through an HTTP/1.1
+// proxy using connect-udp (RFC 9298): the request is upgraded, and from then
+// on every payload travels in a DATAGRAM capsule (RFC 9297) on the TCP
+// connection. It implements net.PacketConn so a quic.Transport can use it.
+type udpTunnel struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	target tunnelAddr
+
+	writeMu sync.Mutex
+}
+
+// tunnelAddr is the address of the server at the far end of a tunnel
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "connect-udp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// openUDPTunnel asks proxy to relay UDP to target. The proxy must answer
+// the upgrade request with 101 Switching Protocols.
+func openUDPTunnel(ctx context.Context, proxy, target string) (*udpTunnel, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The default URI template from RFC 9298
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("http://%s/.well-known/masque/udp/%s/%s/", proxy, url.PathEscape(host), url.PathEscape(port)), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "connect-udp")
+	req.Header.Set("Capsule-Protocol", "?1")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("connect-udp refused: %s", resp.Status)
+	}
+	return &udpTunnel{conn: conn, reader: reader, target: tunnelAddr(target)}, nil
+}
+
+// ReadFrom returns the next UDP payload from the tunnel, skipping capsules
+// of other types and datagrams for contexts other than 0 (plain UDP)
+func (t *udpTunnel) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		capsuleType, err := quicvarint.Read(t.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		length, err := quicvarint.Read(t.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		capsule := io.LimitReader(t.reader, int64(length))
+		if capsuleType != 0x00 {
+			if _, err := io.Copy(io.Discard, capsule); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		contextID, err := quicvarint.Read(quicvarint.NewReader(capsule))
+		if err != nil {
+			return 0, nil, err
+		}
+		payload, err := io.ReadAll(capsule)
+		if err != nil {
+			return 0, nil, err
+		}
+		if contextID != 0 {
+			continue
+		}
+		return copy(p, payload), t.target, nil
+	}
+}
+
+// WriteTo sends one UDP payload through the tunnel; addr is always the target
+func (t *udpTunnel) WriteTo(p []byte, _ net.Addr) (int, error) {
+	capsule := quicvarint.Append(nil, 0x00) // DATAGRAM
+	capsule = quicvarint.Append(capsule, uint64(quicvarint.Len(0)+len(p)))
+	capsule = quicvarint.Append(capsule, 0) // context ID 0 carries UDP payloads
+	capsule = append(capsule, p...)
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if _, err := t.conn.Write(capsule); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *udpTunnel) Close() error                       { return t.conn.Close() }
+func (t *udpTunnel) LocalAddr() net.Addr                { return t.conn.LocalAddr() }
+func (t *udpTunnel) SetDeadline(d time.Time) error      { return t.conn.SetDeadline(d) }
+func (t *udpTunnel) SetReadDeadline(d time.Time) error  { return t.conn.SetReadDeadline(d) }
+func (t *udpTunnel) SetWriteDeadline(d time.Time) error { return t.conn.SetWriteDeadline(d) }
+
+func breakerFor(addr string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[addr]
+	if !ok {
+		b = &circuitBreaker{threshold: *breakerThreshold, cooldown: *breakerCooldown}
+		breakers[addr] = b
+	}
+	return b
+}
+
+// circuitBreaker tracks consecutive connection failures to one server.
+// After threshold failures it opens and rejects attempts immediately; once
+// cooldown has passed it lets a single probe through, closing again if the
+// probe succeeds and staying open for another cooldown if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Allow returns errCircuitOpen if an attempt shouldn't be made right now
+func (b *circuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return errCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// Record feeds the outcome of an attempt allowed by Allow back into the breaker
+func (b *circuitBreaker) Record(addr string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.threshold > 0 && b.failures >= b.threshold
+	b.probing = false
+	if err == nil {
+		if wasOpen {
+			fmt.Printf("🔌 Circuit for %s closed again\n", addr)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		fmt.Printf("⚡ Circuit for %s open after %d consecutive failures, failing fast for %v\n", addr, b.failures, b.cooldown)
+	}
+}
+
+// Result describes a single request/response exchange on one stream
+type Result struct {
+	StreamID      quic.StreamID
+	BytesSent     int
+	BytesReceived int
+	Response      []byte
+	Duration      time.Duration // from opening the stream to reading the last byte
+	Err           error
+}
+
+// echo sends message on a new stream and reads the complete response
+func echo(ctx context.Context, conn *quic.Conn, message string) (result Result) {
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		result.Err = fmt.Errorf("opening stream: %w", err)
+		return result
+	}
+	result.StreamID = stream.StreamID()
+	body := requestStream(conn, stream)
+
+	result.BytesSent, err = body.Write([]byte(message))
+	if err != nil {
+		result.Err = fmt.Errorf("sending message: %w", err)
+		return result
+	}
+
+	// Close the write side to signal we're done sending
+	body.Close()
+
+	// Read the whole response; large echoes arrive over many packets
+	// and a single Read only returns what has arrived so far
+	result.Response, err = io.ReadAll(body)
+	result.BytesReceived = len(result.Response)
+	if err != nil {
+		result.Err = fmt.Errorf("reading response: %w", err)
+	}
+	return result
+}
+
+// echoLines sends each message as a line of a single stream and reads the
+// server's numbered copy of it through a bufio.Reader before sending the
+// next. A bare Read returns whatever has arrived, which may be half a line
+// or several; the buffered reader hands back exactly one line at a time
+// and keeps the rest for the next.
+func echoLines(ctx context.Context, conn *quic.Conn, messages []string) error {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("opening stream: %w", err)
+	}
+	body := requestStream(conn, stream)
+	reader := bufio.NewReader(body)
+
+	for _, message := range messages {
+		start := time.Now()
+		fmt.Printf("📤 Sending line: %s\n", message)
+		if _, err := io.WriteString(body, message+"\n"); err != nil {
+			return fmt.Errorf("sending line: %w", err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading line: %w", err)
+		}
+		fmt.Printf("📥 Received line in %v: %s\n", time.Since(start), strings.TrimSuffix(line, "\n"))
+	}
+
+	// Close the write side; the server answers with the end of the stream
+	body.Close()
+	if rest, err := io.ReadAll(reader); err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	} else if len(rest) > 0 {
+		return fmt.Errorf("unexpected %d bytes after the last line", len(rest))
+	}
+	return nil
+}
+
+// requestStream returns what to write a request to and read the response
+// from: the stream itself or, on a connection that negotiated compression,
+// the stream deflated both ways. Closing it ends the request.
+func requestStream(conn *quic.Conn, stream *quic.Stream) io.ReadWriteCloser {
+	if conn.ConnectionState().TLS.NegotiatedProtocol == alpnCompressed {
+		return newDeflateStream(stream)
+	}
+	return stream
+}
+
+// deflateStream deflates everything written to a stream and inflates
+// everything read from it. Every write is flushed, so each line of
+// -number-lines reaches the server right away.
+type deflateStream struct {
+	*quic.Stream
+	zw *flate.Writer
+	zr io.ReadCloser
+}
+
+func newDeflateStream(stream *quic.Stream) *deflateStream {
+	// Only invalid compression levels fail
+	zw, _ := flate.NewWriter(stream, flate.DefaultCompression)
+	return &deflateStream{Stream: stream, zw: zw, zr: flate.NewReader(stream)}
+}
+
+// Write returns len(p), not the compressed size, when all of p was sent
+func (s *deflateStream) Write(p []byte) (int, error) {
+	if _, err := s.zw.Write(p); err != nil {
+		return 0, err
+	}
+	if err := s.zw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *deflateStream) Read(p []byte) (int, error) { return s.zr.Read(p) }
+
+// Close ends the compressed data and closes the write side of the stream
+func (s *deflateStream) Close() error {
+	if err := s.zw.Close(); err != nil {
+		return err
+	}
+	return s.Stream.Close()
+}
+
+// echoOnce dials addr and performs a single echo on a fresh connection
+func echoOnce(addr, message string, tlsConf *tls.Config, quicConf *quic.Config) Result {
+	ctx := context.Background()
+	conn, err := dial(ctx, strings.TrimSpace(addr), tlsConf, quicConf)
+	if err != nil {
+		return Result{Err: err}
+	}
+	defer conn.CloseWithError(0, *closeReason)
+
+	return echoWithRetry(ctx, conn, message)
+}
+
+// echoWithRetry runs echo up to -stream-attempts times, each on a new
+// stream, backing off between attempts. Only resets that say the server was
+// slow or busy are retried; anything else fails straight away.
+func echoWithRetry(ctx context.Context, conn *quic.Conn, message string) Result {
+	delay := *streamRetryDelay
+	for attempt := 1; ; attempt++ {
+		result := echo(ctx, conn, message)
+		if result.Err == nil || attempt >= *streamAttempts || !isRetryable(result.Err) {
+			return result
+		}
+		fmt.Printf("🔁 Stream %d failed (%v), retrying in %v (attempt %d of %d)\n",
+			result.StreamID, result.Err, delay, attempt+1, *streamAttempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result
+		}
+		delay *= 2
+	}
+}
+
+// isRetryable reports whether err is a stream reset worth trying again on a
+// new stream of the same connection
+func isRetryable(err error) bool {
+	var streamErr *quic.StreamError
+	if !errors.As(err, &streamErr) || !streamErr.Remote {
+		return false
+	}
+	switch streamErr.ErrorCode {
+	case errorCodeHandlerTimeout, errorCodeSingleStream:
+		return true
+	}
+	return false
+}
+
+// logPeerClose prints the server's close reason when err was caused by the
+// server closing the connection
+func logPeerClose(err error) {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote {
+		fmt.Printf("👋 Server closed the connection: %q (code %d)\n", appErr.ErrorMessage, appErr.ErrorCode)
+	}
+}
+
+// printResult shows a successful exchange the way the examples always have
+func printResult(result Result) {
+	if result.BytesReceived > 0 {
+		fmt.Printf("📨 Received: %s\n", result.Response)
+	}
+	fmt.Printf("📊 Stream %d: sent %d bytes, received %d bytes in %v\n",
+		result.StreamID, result.BytesSent, result.BytesReceived, result.Duration)
+}
+
+// newConnectionTracer logs how the QUIC version for the connection was chosen
+// and which packet sizes the connection uses
+func newConnectionTracer(_ context.Context, _ logging.Perspective, _ logging.ConnectionID) *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		ReceivedVersionNegotiationPacket: func(_, _ logging.ArbitraryLenConnectionID, versions []logging.Version) {
+			fmt.Printf("🔀 Server doesn't support our initial version, it offers %v\n", versions)
+		},
+		NegotiatedVersion: func(chosen logging.Version, _, serverVersions []logging.Version) {
+			if len(serverVersions) > 0 {
+				fmt.Printf("🔀 Retrying with QUIC %s\n", chosen)
+			}
+		},
+		ReceivedTransportParameters: func(params *logging.TransportParameters) {
+			fmt.Printf("📏 Server accepts UDP payloads up to %d bytes\n", params.MaxUDPPayloadSize)
+		},
+		UpdatedMTU: func(mtu logging.ByteCount, done bool) {
+			if done {
+				fmt.Printf("📏 Path MTU discovery settled on %d bytes\n", mtu)
+			}
+		},
+	}
+}
+
+// parseVersions turns a list like "v1,v2" into QUIC versions
+func parseVersions(list string) ([]quic.Version, error) {
+	var versions []quic.Version
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "v1":
+			versions = append(versions, quic.Version1)
+		case "v2":
+			versions = append(versions, quic.Version2)
+		default:
+			return nil, fmt.Errorf("unknown QUIC version %q", name)
+		}
+	}
+	return versions, nil
+}
+
+// certList collects repeated -cert flags
+type certList []string
+
+func (l *certList) String() string { return strings.Join(*l, " ") }
+
+func (l *certList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// load reads every certfile,keyfile pair in the list
+func (l certList) load() ([]tls.Certificate, error) {
+	var certs []tls.Certificate
+	for _, pair := range l {
+		certFile, keyFile, ok := strings.Cut(pair, ",")
+		if !ok {
+			return nil, fmt.Errorf("%q should be certfile,keyfile", pair)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// selectClientCertificate presents the first certificate that the server will
+// accept, based on the CAs and signature schemes it listed in its request.
+func selectClientCertificate(certs []tls.Certificate) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		var reasons []error
+		for i := range certs {
+			err := cri.SupportsCertificate(&certs[i])
+			if err == nil {
+				fmt.Printf("🪪 Presenting client certificate %q\n", certs[i].Leaf.Subject)
+				return &certs[i], nil
+			}
+			reasons = append(reasons, err)
+		}
+		// An empty certificate lets the server decide whether to proceed without one
+		fmt.Printf("⚠️  None of the %d client certificates match the server's request: %v\n", len(certs), errors.Join(reasons...))
+		return &tls.Certificate{}, nil
+	}
+}
@@ -0,0 +1,1123 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Both programs are package main in one directory, so name the files:
+//
+//	go test client.go client_test.go
+
+var errDialFailed = errors.New("dial failed")
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 3, cooldown: time.Minute}
+	for i := range 3 {
+		if err := breaker.Allow(); err != nil {
+			t.Fatalf("attempt %d refused before the threshold: %v", i+1, err)
+		}
+		breaker.Record("server", errDialFailed)
+	}
+	if err := breaker.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Allow() after 3 failures = %v, want %v", err, errCircuitOpen)
+	}
+}
+
+func TestCircuitBreakerSuccessResetsCount(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 2, cooldown: time.Minute}
+	breaker.Record("server", errDialFailed)
+	breaker.Record("server", nil)
+	breaker.Record("server", errDialFailed)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("failures weren't consecutive, but Allow() = %v", err)
+	}
+}
+
+func TestCircuitBreakerProbesAfterCooldown(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 1, cooldown: time.Minute}
+	breaker.Record("server", errDialFailed)
+	breaker.openedAt = time.Now().Add(-2 * time.Minute)
+
+	// Only one probe goes through while it is in flight
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("probe after the cooldown refused: %v", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("second attempt during the probe = %v, want %v", err, errCircuitOpen)
+	}
+
+	// A failed probe keeps it open for another cooldown
+	breaker.Record("server", errDialFailed)
+	if err := breaker.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Allow() after a failed probe = %v, want %v", err, errCircuitOpen)
+	}
+
+	// A successful one closes it
+	breaker.openedAt = time.Now().Add(-2 * time.Minute)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("probe after the second cooldown refused: %v", err)
+	}
+	breaker.Record("server", nil)
+	for i := range 3 {
+		if err := breaker.Allow(); err != nil {
+			t.Fatalf("attempt %d after a successful probe refused: %v", i+1, err)
+		}
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 0, cooldown: time.Minute}
+	for range 10 {
+		breaker.Record("server", errDialFailed)
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("a threshold of 0 disables the breaker, but Allow() = %v", err)
+	}
+}
+
+// setFlag sets a command-line flag for the rest of the test
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+// testServerTLS returns a server configuration with a fresh self-signed
+// certificate, speaking protos
+func testServerTLS(t *testing.T, protos ...string) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   protos,
+	}
+}
+
+// startEchoServer runs a stand-in for server.go on a random local port: every
+// stream is answered with "Echo: " and the request, deflated both ways on
+// connections that negotiated alpnCompressed. answer, if set, handles the
+// stream instead.
+func startEchoServer(t *testing.T, quicConf *quic.Config, answer func(*quic.Conn, *quic.Stream)) *quic.Listener {
+	t.Helper()
+	listener, err := quic.ListenAddr("127.0.0.1:0", testServerTLS(t, alpnCompressed, alpnProtocol), quicConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	if answer == nil {
+		answer = func(conn *quic.Conn, stream *quic.Stream) {
+			body := requestStream(conn, stream)
+			request, err := io.ReadAll(body)
+			if err != nil {
+				stream.CancelWrite(0)
+				return
+			}
+			io.WriteString(body, "Echo: "+string(request))
+			body.Close()
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go answer(conn, stream)
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// testClientTLS is the client configuration main sets up
+func testClientTLS(protos ...string) *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true, NextProtos: protos}
+}
+
+// startConnectUDPProxy runs a minimal RFC 9298 proxy on a random local port:
+// it upgrades connect-udp requests for the default URI template and relays
+// DATAGRAM capsules with context ID 0 to and from the target. relayed counts
+// the payloads it carried in both directions.
+func startConnectUDPProxy(t *testing.T, relayed *atomic.Int64) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/masque/udp/{host}/{port}/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "connect-udp" || r.Header.Get("Capsule-Protocol") != "?1" {
+			http.Error(w, "not a connect-udp request", http.StatusBadRequest)
+			return
+		}
+		udp, err := net.Dial("udp", net.JoinHostPort(r.PathValue("host"), r.PathValue("port")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer udp.Close()
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+
+		go func() {
+			payload := make([]byte, 65536)
+			for {
+				n, err := udp.Read(payload)
+				if err != nil {
+					return
+				}
+				capsule := quicvarint.Append(nil, 0x00)
+				capsule = quicvarint.Append(capsule, uint64(1+n))
+				capsule = quicvarint.Append(capsule, 0)
+				if _, err := conn.Write(append(capsule, payload[:n]...)); err != nil {
+					return
+				}
+				relayed.Add(1)
+			}
+		}()
+		relayCapsules(rw.Reader, udp, relayed)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// relayCapsules forwards the UDP payloads of the DATAGRAM capsules read from
+// the client to udp, until the tunnel closes
+func relayCapsules(reader *bufio.Reader, udp net.Conn, relayed *atomic.Int64) {
+	for {
+		capsuleType, err := quicvarint.Read(reader)
+		if err != nil {
+			return
+		}
+		length, err := quicvarint.Read(reader)
+		if err != nil {
+			return
+		}
+		capsule := make([]byte, length)
+		if _, err := io.ReadFull(reader, capsule); err != nil {
+			return
+		}
+		if capsuleType != 0x00 || len(capsule) == 0 || capsule[0] != 0 {
+			continue
+		}
+		udp.Write(capsule[1:])
+		relayed.Add(1)
+	}
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	server := startEchoServer(t, nil, nil)
+	var relayed atomic.Int64
+	setFlag(t, "proxy", startConnectUDPProxy(t, &relayed))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, server.Addr().String(), testClientTLS(alpnProtocol), &quic.Config{})
+	if err != nil {
+		t.Fatalf("dialing through the proxy: %v", err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+	if _, ok := conn.RemoteAddr().(tunnelAddr); !ok {
+		t.Errorf("connected to %v (%T), want the tunnel's target", conn.RemoteAddr(), conn.RemoteAddr())
+	}
+
+	// Larger than a packet, so the echo spans several capsules each way
+	for _, message := range []string{"through the tunnel", strings.Repeat("capsule ", 1000)} {
+		result := echo(ctx, conn, message)
+		if result.Err != nil {
+			t.Fatalf("echo through the proxy: %v", result.Err)
+		}
+		if want := "Echo: " + message; string(result.Response) != want {
+			t.Errorf("echoed %d bytes, want %d", len(result.Response), len(want))
+		}
+	}
+	if relayed.Load() == 0 {
+		t.Error("the proxy relayed nothing, the connection didn't go through it")
+	}
+}
+
+func TestOpenUDPTunnelRefused(t *testing.T) {
+	var relayed atomic.Int64
+	proxy := startConnectUDPProxy(t, &relayed)
+	// The stand-in proxy can't resolve this, so it answers 502
+	_, err := openUDPTunnel(context.Background(), proxy, "unresolvable.invalid:443")
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("openUDPTunnel() = %v, want connect-udp refused with 502", err)
+	}
+}
+
+func TestCompressedEcho(t *testing.T) {
+	server := startEchoServer(t, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, server.Addr().String(), testClientTLS(alpnCompressed, alpnProtocol), &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+	if proto := conn.ConnectionState().TLS.NegotiatedProtocol; proto != alpnCompressed {
+		t.Fatalf("negotiated %q, want %q", proto, alpnCompressed)
+	}
+
+	message := strings.Repeat("line of compressible text\n", 2000)
+	result := echo(ctx, conn, message)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if want := "Echo: " + message; string(result.Response) != want {
+		t.Errorf("echoed %d bytes, want %d", len(result.Response), len(want))
+	}
+	if result.BytesSent != len(message) {
+		t.Errorf("BytesSent = %d, want the %d uncompressed bytes", result.BytesSent, len(message))
+	}
+}
+
+// Close must end the deflate data before the stream, or the server can't
+// tell a finished request from a truncated one
+func TestDeflateStreamCloseEndsCompressedData(t *testing.T) {
+	inflated := make(chan string, 1)
+	server := startEchoServer(t, nil, func(_ *quic.Conn, stream *quic.Stream) {
+		request, err := io.ReadAll(flate.NewReader(stream))
+		if err != nil {
+			inflated <- "error: " + err.Error()
+		} else {
+			inflated <- string(request)
+		}
+		stream.Close()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, server.Addr().String(), testClientTLS(alpnCompressed), &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := requestStream(conn, stream)
+	for _, line := range []string{"one\n", "two\n", "three"} {
+		if _, err := io.WriteString(body, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-inflated:
+		if got != "one\ntwo\nthree" {
+			t.Errorf("server inflated %q, want %q", got, "one\ntwo\nthree")
+		}
+	case <-ctx.Done():
+		t.Fatal("the server never saw the end of the compressed request")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	remote := func(code quic.StreamErrorCode) error { return &quic.StreamError{ErrorCode: code, Remote: true} }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"handler timeout", remote(errorCodeHandlerTimeout), true},
+		{"single stream", remote(errorCodeSingleStream), true},
+		{"wrapped by echo", fmt.Errorf("reading response: %w", remote(errorCodeHandlerTimeout)), true},
+		{"payload too large", remote(0x1), false},
+		{"draining", remote(0x3), false},
+		{"stalled", remote(0x4), false},
+		{"line timeout", remote(0x6), false},
+		{"reset by us", &quic.StreamError{ErrorCode: errorCodeHandlerTimeout}, false},
+		{"connection closed", &quic.ApplicationError{ErrorCode: 0x2, Remote: true}, false},
+		{"not a reset", errDialFailed, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// resetFirst answers like the server, except that the first stream is
+// reset with code after its request has been read
+func resetFirst(code quic.StreamErrorCode, streams *atomic.Int32) func(*quic.Conn, *quic.Stream) {
+	return func(_ *quic.Conn, stream *quic.Stream) {
+		request, err := io.ReadAll(stream)
+		if err != nil {
+			return
+		}
+		if streams.Add(1) == 1 {
+			stream.CancelRead(code)
+			stream.CancelWrite(code)
+			return
+		}
+		io.WriteString(stream, "Echo: "+string(request))
+		stream.Close()
+	}
+}
+
+func TestEchoWithRetry(t *testing.T) {
+	setFlag(t, "stream-attempts", "3")
+	setFlag(t, "stream-retry-delay", "1ms")
+	tests := []struct {
+		name        string
+		code        quic.StreamErrorCode
+		wantStreams int32
+		wantErr     bool
+	}{
+		{"busy reset is retried", errorCodeHandlerTimeout, 2, false},
+		{"single-stream reset is retried", errorCodeSingleStream, 2, false},
+		{"payload reset is not", 0x1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var streams atomic.Int32
+			server := startEchoServer(t, nil, resetFirst(tt.code, &streams))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := quic.DialAddr(ctx, server.Addr().String(), testClientTLS(alpnProtocol), &quic.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.CloseWithError(0, closeReasonDone)
+
+			result := echoWithRetry(ctx, conn, "retry me")
+			if tt.wantErr {
+				wantStreamErr(t, result.Err, tt.code)
+			} else if result.Err != nil || string(result.Response) != "Echo: retry me" {
+				t.Fatalf("echoWithRetry() = %q, %v, want the echo", result.Response, result.Err)
+			}
+			if got := streams.Load(); got != tt.wantStreams {
+				t.Errorf("server answered %d streams, want %d", got, tt.wantStreams)
+			}
+		})
+	}
+}
+
+// wantStreamErr fails the test unless err is a reset by the server with code
+func wantStreamErr(t *testing.T, err error, code quic.StreamErrorCode) {
+	t.Helper()
+	var streamErr *quic.StreamError
+	if !errors.As(err, &streamErr) || !streamErr.Remote || streamErr.ErrorCode != code {
+		t.Fatalf("got %v, want a reset by the server with code %#x", err, code)
+	}
+}
+
+// startRelay forwards UDP between one client and the server at addr, like
+// a path between them that loses the packets drop picks. It returns the
+// address for the client to dial instead of the server's.
+func startRelay(t *testing.T, addr string, drop func(toClient bool, packet []byte) bool) string {
+	t.Helper()
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		packet := make([]byte, 65536)
+		for {
+			n, from, err := front.ReadFromUDP(packet)
+			if err != nil {
+				return
+			}
+			client.Store(from)
+			if !drop(false, packet[:n]) {
+				back.Write(packet[:n])
+			}
+		}
+	}()
+	go func() {
+		packet := make([]byte, 65536)
+		for {
+			n, err := back.Read(packet)
+			if err != nil {
+				return
+			}
+			if to := client.Load(); to != nil && !drop(true, packet[:n]) {
+				front.WriteToUDP(packet[:n], to)
+			}
+		}
+	}()
+	return front.LocalAddr().String()
+}
+
+// Over a path that loses some of the client's packets, sendDatagrams must
+// count exactly the datagrams the server acknowledged, ignoring
+// acknowledgments for sequence numbers it never sent and repeated ones
+func TestSendDatagramsOverLossyPath(t *testing.T) {
+	const count = 40
+	listener, err := quic.ListenAddr("127.0.0.1:0", testServerTLS(t, alpnProtocol), &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var (
+		mu       sync.Mutex
+		received = make(map[uint64]bool)
+	)
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		for {
+			datagram, err := conn.ReceiveDatagram(context.Background())
+			if err != nil {
+				return
+			}
+			seq := binary.BigEndian.Uint64(datagram)
+			mu.Lock()
+			received[seq] = true
+			mu.Unlock()
+			conn.SendDatagram(datagram[:8])
+			conn.SendDatagram(datagram[:8])
+			conn.SendDatagram(binary.BigEndian.AppendUint64(nil, seq+count))
+		}
+	}()
+
+	// Every fifth of the client's 1-RTT packets never arrives
+	var shortHeaders atomic.Int32
+	addr := startRelay(t, listener.Addr().String(), func(toClient bool, packet []byte) bool {
+		return !toClient && packet[0]&0x80 == 0 && shortHeaders.Add(1)%5 == 0
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, testClientTLS(alpnProtocol), &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+
+	acked := sendDatagrams(conn, count, 5*time.Millisecond, 500*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) == count {
+		t.Fatal("no datagram was lost on the lossy path")
+	}
+	if acked != len(received) {
+		t.Errorf("counted %d acknowledgments, but the server acknowledged %d of %d datagrams", acked, len(received), count)
+	}
+}
+
+// startIdleServer runs a stand-in for a server with -app-idle-timeout: it
+// closes a connection once no stream has arrived on it for timeout, and
+// echoes the ones that do
+func startIdleServer(t *testing.T, timeout time.Duration) *quic.Listener {
+	t.Helper()
+	listener, err := quic.ListenAddr("127.0.0.1:0", testServerTLS(t, alpnProtocol), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			idle := time.AfterFunc(timeout, func() { conn.CloseWithError(0, "application idle") })
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					idle.Reset(timeout)
+					request, _ := io.ReadAll(stream)
+					io.WriteString(stream, "Echo: "+string(request))
+					stream.Close()
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestKeepAppAlive(t *testing.T) {
+	const idleTimeout = 300 * time.Millisecond
+	server := startIdleServer(t, idleTimeout)
+	for _, tt := range []struct {
+		name  string
+		ping  bool
+		alive bool
+	}{
+		{"without app pings", false, false},
+		{"with app pings", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := quic.DialAddr(ctx, server.Addr().String(), testClientTLS(alpnProtocol), &quic.Config{KeepAlivePeriod: 50 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.CloseWithError(0, closeReasonDone)
+			var lastRequest atomic.Int64
+			lastRequest.Store(time.Now().UnixNano())
+			if tt.ping {
+				go keepAppAlive(conn, idleTimeout/3, &lastRequest)
+			}
+
+			select {
+			case <-conn.Context().Done():
+				if tt.alive {
+					t.Fatalf("closed despite app pings: %v", context.Cause(conn.Context()))
+				}
+			case <-time.After(3 * idleTimeout):
+				if !tt.alive {
+					t.Fatal("still open after three idle timeouts without app pings")
+				}
+			}
+		})
+	}
+}
+
+func TestVersionNegotiationLogged(t *testing.T) {
+	server := startEchoServer(t, &quic.Config{Versions: []quic.Version{quic.Version1}}, nil)
+
+	// Catch the tracer's calls so their log lines can be checked on the test's goroutine
+	offered := make(chan []logging.Version, 1)
+	chosen := make(chan logging.Version, 1)
+	quicConf := &quic.Config{
+		Versions: []quic.Version{quic.Version2, quic.Version1},
+		Tracer: func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+			return &logging.ConnectionTracer{
+				ReceivedVersionNegotiationPacket: func(_, _ logging.ArbitraryLenConnectionID, versions []logging.Version) {
+					offered <- versions
+				},
+				NegotiatedVersion: func(version logging.Version, _, serverVersions []logging.Version) {
+					if len(serverVersions) > 0 {
+						chosen <- version
+					}
+				},
+			}
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, server.Addr().String(), testClientTLS(alpnProtocol), quicConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+	if got := conn.ConnectionState().Version; got != quic.Version1 {
+		t.Errorf("negotiated %v, want v1", got)
+	}
+
+	var versions []logging.Version
+	var version logging.Version
+	select {
+	case versions = <-offered:
+	default:
+		t.Fatal("no version negotiation packet was received")
+	}
+	select {
+	case version = <-chosen:
+	default:
+		t.Fatal("the version wasn't renegotiated")
+	}
+	// quic-go adds a reserved version to keep clients from ossifying on the list
+	if !slices.Contains(versions, quic.Version1) {
+		t.Errorf("server offered %v, want v1 among them", versions)
+	}
+	tracer := newConnectionTracer(ctx, logging.PerspectiveClient, logging.ConnectionID{})
+	output := captureOutput(t, func() {
+		tracer.ReceivedVersionNegotiationPacket(nil, nil, versions)
+		tracer.NegotiatedVersion(version, nil, versions)
+	})
+	for _, want := range []string{fmt.Sprintf("Server doesn't support our initial version, it offers %v", versions), "Retrying with QUIC v1"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("logged %q, want it to include %q", output, want)
+		}
+	}
+}
+
+// captureOutput returns what f prints to stdout
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+func TestSelectClientCertificate(t *testing.T) {
+	caA, caAKey := testCA(t, "CA A")
+	caB, caBKey := testCA(t, "CA B")
+	dir := t.TempDir()
+	// Load both, the one the server accepts last
+	certs, err := certList{
+		writeKeyPair(t, dir, "a", issueClientCert(t, caA, caAKey, "client-a")),
+		writeKeyPair(t, dir, "b", issueClientCert(t, caB, caBKey, "client-b")),
+	}.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server only trusts CA B
+	serverTLS := testServerTLS(t, alpnProtocol)
+	serverTLS.ClientCAs = x509.NewCertPool()
+	serverTLS.ClientCAs.AddCert(caB)
+	serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	presented := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		presented <- conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tlsConf := testClientTLS(alpnProtocol)
+	tlsConf.GetClientCertificate = selectClientCertificate(certs)
+	conn, err := quic.DialAddr(ctx, listener.Addr().String(), tlsConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+	select {
+	case name := <-presented:
+		if name != "client-b" {
+			t.Errorf("presented %q, want the certificate issued by the CA the server asked for", name)
+		}
+	case <-ctx.Done():
+		t.Fatal("the server never accepted the connection")
+	}
+}
+
+// testCA returns a self-signed CA certificate and its key
+func testCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// issueClientCert returns a client certificate for commonName signed by ca
+func issueClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeKeyPair writes cert to name.pem and its key to name.key in dir, and
+// returns them as a -cert pair
+func writeKeyPair(t *testing.T, dir, name string, cert tls.Certificate) string {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile + "," + keyFile
+}
+
+func TestScatter(t *testing.T) {
+	a := startEchoServer(t, nil, nil).Addr().String()
+	b := startEchoServer(t, nil, nil).Addr().String()
+	odd := startEchoServer(t, nil, func(conn *quic.Conn, stream *quic.Stream) {
+		io.ReadAll(stream)
+		io.WriteString(stream, "Something else")
+		stream.Close()
+	}).Addr().String()
+	tlsConf := testClientTLS(alpnProtocol)
+
+	var agree bool
+	output := captureOutput(t, func() { agree = scatter([]string{a, b}, "hi", tlsConf, &quic.Config{}) })
+	if !agree {
+		t.Errorf("two echo servers disagree:\n%s", output)
+	}
+	for _, addr := range []string{a, b} {
+		if want := fmt.Sprintf("📨 %s: Echo: hi (", addr); !strings.Contains(output, want) {
+			t.Errorf("output doesn't include %q:\n%s", want, output)
+		}
+	}
+
+	output = captureOutput(t, func() { agree = scatter([]string{a, odd}, "hi", tlsConf, &quic.Config{}) })
+	if agree {
+		t.Errorf("an echo server and one answering differently agree:\n%s", output)
+	}
+	if want := fmt.Sprintf("📨 %s: Something else (", odd); !strings.Contains(output, want) {
+		t.Errorf("output doesn't include %q:\n%s", want, output)
+	}
+}
+
+func TestEchoResult(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	server := startEchoServer(t, nil, func(conn *quic.Conn, stream *quic.Stream) {
+		request, _ := io.ReadAll(stream)
+		time.Sleep(delay)
+		io.WriteString(stream, "Echo: "+string(request))
+		stream.Close()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, server.Addr().String(), testClientTLS(alpnProtocol), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+
+	// Client-initiated bidirectional streams are numbered 0, 4, 8, ...
+	for i, wantID := range []quic.StreamID{0, 4} {
+		result := echo(ctx, conn, "hello")
+		if result.Err != nil {
+			t.Fatalf("echo %d: %v", i+1, result.Err)
+		}
+		if result.StreamID != wantID {
+			t.Errorf("echo %d: StreamID = %d, want %d", i+1, result.StreamID, wantID)
+		}
+		if result.BytesSent != len("hello") {
+			t.Errorf("echo %d: BytesSent = %d, want %d", i+1, result.BytesSent, len("hello"))
+		}
+		if string(result.Response) != "Echo: hello" || result.BytesReceived != len(result.Response) {
+			t.Errorf("echo %d: Response = %q with BytesReceived = %d, want %q and its length", i+1, result.Response, result.BytesReceived, "Echo: hello")
+		}
+		if result.Duration < delay || result.Duration > time.Second {
+			t.Errorf("echo %d: Duration = %v, want the server's %v delay and a little more", i+1, result.Duration, delay)
+		}
+	}
+
+	// A failure still says how far the exchange got
+	conn.CloseWithError(0, closeReasonDone)
+	if result := echo(ctx, conn, "hello"); result.Err == nil || result.BytesSent != 0 {
+		t.Errorf("echo on a closed connection = %+v, want an error and nothing sent", result)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	setFlag(t, "close-reason", "benchmark over")
+	listener, err := quic.ListenAddr("127.0.0.1:0", testServerTLS(t, alpnProtocol), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Answer one echo, then report why the client closed the connection
+	reasons := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			reasons <- err
+			return
+		}
+		if stream, err := conn.AcceptStream(context.Background()); err == nil {
+			request, _ := io.ReadAll(stream)
+			io.WriteString(stream, "Echo: "+string(request))
+			stream.Close()
+		}
+		<-conn.Context().Done()
+		reasons <- context.Cause(conn.Context())
+	}()
+
+	if result := echoOnce(listener.Addr().String(), "hi", testClientTLS(alpnProtocol), nil); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	select {
+	case err := <-reasons:
+		var appErr *quic.ApplicationError
+		if !errors.As(err, &appErr) || !appErr.Remote || appErr.ErrorCode != 0 || appErr.ErrorMessage != "benchmark over" {
+			t.Errorf("server saw the connection end with %v, want the client to close it with -close-reason", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection is still open after the echo")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		quicConf  *quic.Config
+		datagrams bool
+		streams   int64
+	}{
+		{"defaults", nil, false, 100},
+		{"datagrams and a stream limit", &quic.Config{EnableDatagrams: true, MaxIncomingStreams: 7}, true, 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startEchoServer(t, tt.quicConf, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			report, err := probe(ctx, server.Addr().String(), testClientTLS(alpnProtocol), &quic.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.ALPN != alpnProtocol || report.QUICVersion != quic.Version1.String() || report.TLSVersion != "TLS 1.3" {
+				t.Errorf("negotiated %s over QUIC %s and %s, want %s over QUIC v1 and TLS 1.3", report.ALPN, report.QUICVersion, report.TLSVersion, alpnProtocol)
+			}
+			if !report.EchoWorks {
+				t.Error("the echo failed")
+			}
+			if report.Datagrams != tt.datagrams || (report.TransportParams.MaxDatagramFrameSize > 0) != tt.datagrams {
+				t.Errorf("datagrams %v with a max frame size of %d, want support %v", report.Datagrams, report.TransportParams.MaxDatagramFrameSize, tt.datagrams)
+			}
+			if report.TransportParams.MaxBidiStreams != tt.streams {
+				t.Errorf("server allows %d streams, want %d", report.TransportParams.MaxBidiStreams, tt.streams)
+			}
+			// The server sends session tickets but doesn't accept 0-RTT
+			if !report.Resumption || report.ZeroRTT {
+				t.Errorf("resumption %v and 0-RTT %v (%s), want resumption only", report.Resumption, report.ZeroRTT, report.ResumptionDetail)
+			}
+		})
+	}
+}
+
+func TestDialUnknownALPN(t *testing.T) {
+	setFlag(t, "dial-attempts", "3")
+	server := startEchoServer(t, nil, nil)
+	addr := server.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var err error
+	output := captureOutput(t, func() { _, err = dial(ctx, addr, testClientTLS("not-ours"), nil) })
+	var transportErr *quic.TransportError
+	if !errors.As(err, &transportErr) || transportErr.ErrorCode != errorCodeNoALPN {
+		t.Fatalf("got %v, want the server's no_application_protocol alert", err)
+	}
+	// No point in trying again
+	if strings.Contains(output, "Attempt 2") {
+		t.Errorf("retried a server that speaks none of our protocols:\n%s", output)
+	}
+	if want := fmt.Sprintf("%s speaks none of the application protocols we offered: %q", addr, []string{"not-ours"}); !strings.Contains(output, want) {
+		t.Errorf("output doesn't include %q:\n%s", want, output)
+	}
+}
+
+func TestWarmupConnection(t *testing.T) {
+	// The server notes the order requests arrive and are answered in
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	note := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	server := startEchoServer(t, nil, func(conn *quic.Conn, stream *quic.Stream) {
+		request, _ := io.ReadAll(stream)
+		note("received " + string(request))
+		// Noted before the client can have the answer, so the order is certain
+		note("answering " + string(request))
+		io.WriteString(stream, "Echo: "+string(request))
+		stream.Close()
+	})
+
+	var confirmed atomic.Bool
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, server.Addr().String(), testClientTLS(alpnProtocol), &quic.Config{
+		Tracer: func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+			return &logging.ConnectionTracer{
+				ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+					if slices.ContainsFunc(frames, func(f logging.Frame) bool { _, ok := f.(*logging.HandshakeDoneFrame); return ok }) {
+						confirmed.Store(true)
+					}
+				},
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, closeReasonDone)
+
+	warmupConnection(ctx, conn)
+	// The ping's round trip covers the server confirming the handshake
+	if !confirmed.Load() {
+		t.Error("the warmup returned before the server confirmed the handshake")
+	}
+	if result := echo(ctx, conn, "request"); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"received ping", "answering ping", "received request", "answering request"}; !slices.Equal(events, want) {
+		t.Errorf("server saw %q, want the ping answered before the request arrived", events)
+	}
+}
+
+// numberLinesServer answers each line with its number, like server.go's
+// -number-lines, but dribbles every answer out a byte at a time and then
+// writes trailer after the last one
+func numberLinesServer(t *testing.T, trailer string) string {
+	t.Helper()
+	return startEchoServer(t, nil, func(conn *quic.Conn, stream *quic.Stream) {
+		reader := bufio.NewReader(stream)
+		for n := 1; ; n++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			for _, b := range []byte(fmt.Sprintf("%6d\t%s", n, line)) {
+				stream.Write([]byte{b})
+			}
+		}
+		io.WriteString(stream, trailer)
+		stream.Close()
+	}).Addr().String()
+}
+
+func TestEchoLines(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialLines := func(addr string) *quic.Conn {
+		conn, err := quic.DialAddr(ctx, addr, testClientTLS(alpnProtocol), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.CloseWithError(0, closeReasonDone) })
+		return conn
+	}
+
+	conn := dialLines(numberLinesServer(t, ""))
+	var err error
+	output := captureOutput(t, func() { err = echoLines(ctx, conn, []string{"first", "second", "third"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range []string{"first", "second", "third"} {
+		if want := fmt.Sprintf(": %6d\t%s\n", i+1, line); !strings.Contains(output, want) {
+			t.Errorf("output doesn't include line %d as %q:\n%s", i+1, want, output)
+		}
+	}
+
+	// Whatever the buffered reader holds past the last line counts too
+	conn = dialLines(numberLinesServer(t, "junk"))
+	captureOutput(t, func() { err = echoLines(ctx, conn, []string{"only"}) })
+	if err == nil || !strings.Contains(err.Error(), "unexpected 4 bytes after the last line") {
+		t.Errorf("got %v, want the trailing bytes reported", err)
+	}
+}
@@ -1,130 +1,2769 @@
-package main
-
-import (
-	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
-	"fmt"
-	"io"
-	"log"
-	"math/big"
-	"net"
-	"time"
-
-	"github.com/quic-go/quic-go"
-)
-
-func main() {
-	// Generate a self-signed certificate for testing
-	tlsConf := generateTLSConfig()
-
-	// Listen on localhost:4242
-	listener, err := quic.ListenAddr("localhost:4242", tlsConf, nil)
-	if err != nil {
-		log.Fatal("Failed to listen:", err)
-	}
-	defer listener.Close()
-
-	fmt.Println("🚀 QUIC Server listening on localhost:4242")
-	fmt.Println("📡 Waiting for connections...")
-
-	for {
-		// Accept a QUIC connection
-		conn, err := listener.Accept(context.Background())
-		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			continue
-		}
-
-		fmt.Printf("🔗 New connection from %s\n", conn.RemoteAddr())
-
-		// Handle connection in a goroutine
-		go handleConnection(conn)
-	}
-}
-
-func handleConnection(conn *quic.Conn) {
-	defer conn.CloseWithError(0, "")
-
-	for {
-		// Accept a stream from the client
-		stream, err := conn.AcceptStream(context.Background())
-		if err != nil {
-			fmt.Printf("❌ Connection closed: %v\n", err)
-			return
-		}
-
-		fmt.Printf("📋 New stream %d opened\n", stream.StreamID())
-
-		// Handle stream in goroutine
-		go handleStream(stream)
-	}
-}
-
-func handleStream(stream *quic.Stream) {
-	defer stream.Close()
-
-	// Read data from client
-	buffer := make([]byte, 1024)
-	n, err := stream.Read(buffer)
-	if err != nil && err != io.EOF {
-		fmt.Printf("❌ Error reading from stream: %v\n", err)
-		return
-	}
-
-	message := string(buffer[:n])
-	fmt.Printf("📨 Received: %s\n", message)
-
-	// Echo back with a prefix
-	response := fmt.Sprintf("Echo: %s", message)
-	_, err = stream.Write([]byte(response))
-	if err != nil {
-		fmt.Printf("❌ Error writing to stream: %v\n", err)
-		return
-	}
-
-	fmt.Printf("📤 Sent: %s\n", response)
-}
-
-// Generate a self-signed certificate for testing
-func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"QUIC Learning Lab"},
-		},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
-		DNSNames:     []string{"localhost"},
-	}
-
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"quic-learning-lab"},
-	}
-}
\ No newline at end of file
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Connection error codes sent to the client when the server closes a
+// connection on purpose: errorCodeVersionTooOld for a QUIC version older
+// than -min-version, errorCodeShed for one that didn't fit under -max-conns
+const (
+	errorCodeVersionTooOld quic.ApplicationErrorCode = 0x1
+	errorCodeShed          quic.ApplicationErrorCode = 0x2
+)
+
+// Stream error codes sent to the client when the server resets a stream
+const (
+	errorCodePayloadTooLarge quic.StreamErrorCode = 0x1
+	errorCodeHandlerTimeout  quic.StreamErrorCode = 0x2
+	errorCodeDraining        quic.StreamErrorCode = 0x3
+	errorCodeStalled         quic.StreamErrorCode = 0x4
+	errorCodeSingleStream    quic.StreamErrorCode = 0x5
+	errorCodeLineTimeout     quic.StreamErrorCode = 0x6
+)
+
+// alpnProtocol is the application protocol the server speaks, and
+// alpnCompressed the same protocol with every stream deflated, for -compress
+const (
+	alpnProtocol   = "quic-learning-lab"
+	alpnCompressed = "quic-learning-lab+deflate"
+)
+
+// Reasons sent to the client when the server closes a connection
+const (
+	closeReasonDone     = "server done"
+	closeReasonDraining = "server draining"
+	closeReasonIdle     = "application idle"
+	closeReasonShed     = "shed for a higher-priority connection"
+	closeReasonFull     = "server full"
+)
+
+var (
+	errPayloadTooLarge   = errors.New("payload too large")
+	errTooManyHandshakes = errors.New("too many handshakes in progress")
+	errConnRateExceeded  = errors.New("connection rate exceeded")
+	errStalled           = errors.New("no data arrived within the progress timeout")
+	errLineTimeout       = errors.New("line not finished within the line timeout")
+)
+
+var (
+	listenAddr      = flag.String("addr", "localhost:4242", "UDP address to listen on")
+	fallbackAddr    = flag.String("fallback-addr", "", "UDP address to listen on instead when -addr can't be bound, e.g. because the port is taken")
+	maxBuffer       = flag.Int("max-buffer", 64*1024, "maximum bytes buffered per stream before it is reset")
+	quicVersions    = flag.String("versions", "v1,v2", "comma-separated QUIC versions the server accepts")
+	minVersionName  = flag.String("min-version", "", "close connections that negotiated a QUIC version older than this one, e.g. v2")
+	jitterSpec      = flag.String("jitter", "", "random delay added to each response, as a maximum (100ms) or a range (50ms-200ms)")
+	seed            = flag.Int64("seed", 0, "seed for the random number generator (0 picks one from the clock)")
+	certPair        = flag.String("cert", "", "serve this certificate as certfile,keyfile instead of a freshly generated one (see gencert)")
+	keyType         = flag.String("key-type", "rsa", "key type of the generated certificate: rsa (2048 bit) or ecdsa (P-256, cheaper handshakes)")
+	clientCA        = flag.String("client-ca", "", "PEM file of CAs; when set, clients must present a certificate signed by one of them")
+	highPriority    = flag.String("high-priority", "", "comma-separated client certificate common names or organizational units whose connections are high priority under -max-conns (needs -client-ca)")
+	handlerTimeout  = flag.Duration("handler-timeout", 0, "maximum time a stream handler may take from first read to last write (0 disables)")
+	numberLines     = flag.Bool("number-lines", false, "echo newline-delimited input with each line numbered, like cat -n")
+	compress        = flag.Bool("compress", false, "deflate all stream data of connections whose client offers it during the handshake (the client's -compress)")
+	transformSpec   = flag.String("transform", "", "comma-separated transforms applied in order to the echoed payload: "+strings.Join(transformNames(), ", "))
+	digestInput     = flag.Bool("digest", false, "instead of echoing, answer with the size, line and word counts and SHA-256 of the input, computed as it streams in")
+	packetSize      = flag.Uint("initial-packet-size", 0, "initial UDP payload size in bytes (0 uses the quic-go default of 1280)")
+	disablePMTUD    = flag.Bool("disable-mtu-discovery", false, "never grow packets beyond -initial-packet-size")
+	metricsAddr     = flag.String("metrics-addr", "", "address to serve expvar metrics on at /debug/vars, e.g. localhost:9090")
+	drainFile       = flag.String("drain-file", "", "start a graceful drain as soon as this file exists")
+	drainPoll       = flag.Duration("drain-poll", time.Second, "how often to check for -drain-file")
+	maxHandshakes   = flag.Int("max-handshakes", 0, "maximum TLS handshakes in progress at once (0 is unlimited)")
+	maxConns        = flag.Int("max-conns", 0, "maximum open connections; at the limit a new one sheds a lower-priority connection or is refused (0 is unlimited)")
+	handshakeWait   = flag.Duration("handshake-wait", 100*time.Millisecond, "how long a handshake waits for a free slot under -max-handshakes or its turn under -max-conn-rate before it is rejected")
+	maxConnRate     = flag.Float64("max-conn-rate", 0, "maximum new connections per second; faster arrivals are spaced out (0 is unlimited)")
+	connBurst       = flag.Int("conn-burst", 1, "connections -max-conn-rate lets through at once before spacing them out")
+	cacheSize       = flag.Int("cache-size", 0, "number of responses to memoize by request hash (0 disables the cache)")
+	cacheTTL        = flag.Duration("cache-ttl", time.Minute, "how long a memoized response stays valid")
+	debug           = flag.Bool("debug", false, "also log routine events, such as clients leaving in the middle of a stream")
+	overhead        = flag.Bool("overhead", false, "report bytes on the wire versus payload bytes when each connection closes")
+	drainTimeout    = flag.Duration("drain-timeout", 5*time.Second, "how long a drain waits for clients to disconnect before closing their connections")
+	progressTimeout = flag.Duration("progress-timeout", 0, "reset a stream when no data arrives from the client for this long (0 disables)")
+	lineTimeout     = flag.Duration("line-timeout", 0, "with -number-lines, reset a stream when a started line isn't finished within this long (0 disables)")
+	connIDLength    = flag.Int("conn-id-length", 4, "length in bytes of the connection IDs the server issues (1-20)")
+	hookTimeout     = flag.Duration("shutdown-hook-timeout", 5*time.Second, "how long each shutdown hook may run")
+	datagramAck     = flag.Bool("datagram-ack", false, "accept QUIC datagrams and answer each one with an acknowledgment datagram carrying its sequence number")
+	nodelay         = flag.Bool("nodelay", true, "send every write right away; false holds small writes in -number-lines mode back briefly so they share packets")
+	singleStream    = flag.Bool("single-stream", false, "reset any stream opened while another one on the same connection is still being handled")
+	appIdleTimeout  = flag.Duration("app-idle-timeout", 0, "close a connection once no stream has been open on it for this long, however many QUIC PINGs keep it alive (0 disables)")
+	cannedResponse  = flag.String("canned-response", "", "answer every request with this response instead of echoing it")
+	cannedFile      = flag.String("canned-response-file", "", "answer every request with the contents of this file instead of echoing it")
+	blockedWarning  = flag.Duration("blocked-warning", 5*time.Second, "warn when writing a response has been blocked by the client's flow control for this long (0 disables)")
+	connLogLimit    = flag.Int("conn-log-limit", 20, "errors logged per connection before the rest are only counted and summarized when it closes (0 is unlimited)")
+	dumpStacks      = flag.Bool("dump-stacks", false, "include every goroutine's stack in the diagnostics printed on SIGQUIT")
+	linger          = flag.Duration("linger", 0, "after a response, wait up to this long for the client to acknowledge all of it before the handler finishes (0 finishes immediately)")
+)
+
+// writeCoalesceDelay is how long -nodelay=false holds a write back waiting
+// for more data, and writeCoalesceSize how much it holds at most
+const (
+	writeCoalesceDelay = 10 * time.Millisecond
+	writeCoalesceSize  = 16 * 1024
+)
+
+// Server metrics, published through expvar
+var (
+	handshakeDuration = newHistogram(0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5)
+	cacheHits         = expvar.NewInt("cache_hits")
+	cacheMisses       = expvar.NewInt("cache_misses")
+	connsShed         = expvar.NewMap("connections_shed")
+	handshakeAborts   = expvar.NewMap("handshake_aborts")
+	droppedPackets    = expvar.NewMap("dropped_packets")
+	flowBlocked       = expvar.NewMap("flow_control_blocked")
+	flowUtilization   = expvar.NewMap("flow_control_utilization")
+)
+
+// Gauges inside flowUtilization, set by sampleFlowControl
+var connectionUtilization, streamUtilization expvar.Float
+
+func init() {
+	expvar.Publish("handshake_duration_seconds", handshakeDuration)
+	flowUtilization.Set("connection", &connectionUtilization)
+	flowUtilization.Set("stream", &streamUtilization)
+}
+
+// handshakeStartKey stores when a connection attempt arrived in its context
+type handshakeStartKey struct{}
+
+// handshakeSlotKey stores a connection's *handshakeSlot in its context
+type handshakeSlotKey struct{}
+
+// wireStatsKey stores a connection's *wireStats in its context, so the
+// tracer and the stream handlers can update the same counters
+type wireStatsKey struct{}
+
+// flowStatsKey stores a connection's *flowStats in its context
+type flowStatsKey struct{}
+
+// deliveryKey stores a connection's *deliveryTracker in its context
+type deliveryKey struct{}
+
+// responseJitter is set from -jitter; nil means responses aren't delayed
+var responseJitter *jitter
+
+// echoTransform is set from -transform; nil means the payload is echoed as is
+var echoTransform transform
+
+// canned is set from -canned-response or -canned-response-file; nil means
+// requests are echoed
+var canned []byte
+
+// handshakes is set from -max-handshakes; nil means handshakes aren't limited
+var handshakes *handshakeLimiter
+
+// connRate is set from -max-conn-rate; nil means new connections aren't paced
+var connRate *connRateLimiter
+
+// highPriorityNames is set from -high-priority: the client certificate
+// common names and organizational units that make a connection high priority
+var highPriorityNames map[string]bool
+
+// responses is set from -cache-size; nil means every request is processed
+var responses *responseCache
+
+// Drain state: once draining, no new streams are taken on and the server
+// exits after the in-flight ones finish
+var (
+	drainMu  sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+
+	connsMu sync.Mutex
+	conns   = make(map[*connState]struct{})
+)
+
+func main() {
+	flag.Parse()
+
+	versions, err := parseVersions(*quicVersions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var minVersion quic.Version
+	if *minVersionName != "" {
+		parsed, err := parseVersions(*minVersionName)
+		if err != nil || len(parsed) != 1 {
+			log.Fatalf("-min-version must be a single QUIC version, got %q", *minVersionName)
+		}
+		minVersion = parsed[0]
+	}
+
+	if flag.Arg(0) == "gencert" {
+		if err := gencert(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "handshake-bench" {
+		if err := handshakeBench(flag.Args()[1:], versions); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	if *jitterSpec != "" {
+		responseJitter, err = parseJitter(*jitterSpec, *seed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("🎲 Adding %v-%v response jitter (seed %d)\n", responseJitter.min, responseJitter.max, *seed)
+	}
+	if *numberLines && *digestInput {
+		log.Fatal("-number-lines and -digest are mutually exclusive")
+	}
+	switch {
+	case *cannedResponse != "" && *cannedFile != "":
+		log.Fatal("-canned-response and -canned-response-file are mutually exclusive")
+	case *cannedResponse != "":
+		canned = []byte(*cannedResponse)
+	case *cannedFile != "":
+		canned, err = os.ReadFile(*cannedFile)
+		if err != nil {
+			log.Fatal("Failed to load canned response:", err)
+		}
+	}
+	if *transformSpec != "" {
+		echoTransform, err = parseTransforms(*transformSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("🔀 Transforming echoed payloads with %s\n", *transformSpec)
+	}
+	if canned != nil {
+		fmt.Printf("🥫 Answering every request with the same %d-byte response\n", len(canned))
+	}
+
+	// Generate a self-signed certificate for testing, unless one was given
+	var tlsConf *tls.Config
+	if *certPair != "" {
+		tlsConf, err = loadTLSConfig(*certPair)
+		if err != nil {
+			log.Fatal("Failed to load certificate:", err)
+		}
+		fmt.Printf("📜 Serving certificate %s\n", *certPair)
+	} else {
+		tlsConf = generateTLSConfig()
+	}
+	if *clientCA != "" {
+		if err := requireClientCerts(tlsConf, *clientCA); err != nil {
+			log.Fatal("Failed to load client CAs:", err)
+		}
+		fmt.Printf("🪪 Requiring client certificates signed by %s\n", *clientCA)
+	}
+	if *highPriority != "" {
+		if *clientCA == "" {
+			log.Fatal("-high-priority needs -client-ca, the priority comes from the client certificate")
+		}
+		highPriorityNames = make(map[string]bool)
+		for _, name := range strings.Split(*highPriority, ",") {
+			highPriorityNames[strings.TrimSpace(name)] = true
+		}
+	}
+	if *maxConns > 0 {
+		fmt.Printf("🏷️  Allowing at most %d open connections, shedding low-priority ones first\n", *maxConns)
+	}
+	if *cacheSize > 0 {
+		responses = newResponseCache(*cacheSize, *cacheTTL)
+		fmt.Printf("💾 Caching up to %d responses for %v\n", *cacheSize, *cacheTTL)
+	}
+	if *maxHandshakes > 0 {
+		handshakes = newHandshakeLimiter(*maxHandshakes, *handshakeWait)
+		fmt.Printf("🚦 Allowing at most %d concurrent handshakes\n", *maxHandshakes)
+	}
+	if *maxConnRate > 0 {
+		connRate = newConnRateLimiter(*maxConnRate, max(*connBurst, 1), *handshakeWait)
+		fmt.Printf("🚦 Accepting at most %g new connections per second (bursts of %d)\n", *maxConnRate, max(*connBurst, 1))
+	}
+	tlsConf.GetConfigForClient = getConfigForClient
+	if *connIDLength < 1 || *connIDLength > 20 {
+		log.Fatalf("-conn-id-length must be between 1 and 20, got %d", *connIDLength)
+	}
+	quicConf := &quic.Config{
+		Versions:                versions,
+		InitialPacketSize:       uint16(*packetSize),
+		DisablePathMTUDiscovery: *disablePMTUD,
+		EnableDatagrams:         *datagramAck,
+		Tracer:                  newConnectionTracer,
+	}
+
+	// The self-test serves with everything set up so far
+	if flag.Arg(0) == "selftest" {
+		if !selftest(tlsConf, quicConf, minVersion) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	udpConn, err := listenWithFallback(*listenAddr, *fallbackAddr)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	transport := newTransport(udpConn)
+	defer transport.Close()
+	listener, err := transport.Listen(tlsConf, quicConf)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	fmt.Printf("🚀 QUIC Server listening on %s\n", udpConn.LocalAddr())
+	fmt.Printf("🔢 Accepting QUIC versions: %v\n", versions)
+	if minVersion != 0 {
+		fmt.Printf("🔒 Requiring QUIC %v or newer\n", minVersion)
+	}
+	fmt.Printf("🆔 Issuing %d-byte connection IDs\n", *connIDLength)
+	fmt.Println("📡 Waiting for connections...")
+
+	if *metricsAddr != "" {
+		go func() {
+			fmt.Printf("📈 Serving metrics on http://%s/debug/vars\n", *metricsAddr)
+			log.Printf("Metrics server stopped: %v", http.ListenAndServe(*metricsAddr, nil))
+		}()
+		RegisterShutdownHook(printFinalStats)
+		go sampleFlowControl(time.Second)
+	}
+	go dumpOnSignal()
+
+	if *drainFile != "" {
+		fmt.Printf("🚰 Will drain when %s appears\n", *drainFile)
+		go watchDrainFile(*drainFile, *drainPoll, listener)
+	}
+
+	acceptConnections(listener, minVersion)
+
+	if isDraining() {
+		fmt.Println("⏳ Draining: no longer accepting, waiting for in-flight streams...")
+		inflight.Wait()
+
+		// Closing a connection drops stream data the client hasn't acknowledged
+		// yet, so give clients a chance to read their responses and leave first
+		if remaining := waitForDisconnects(*drainTimeout); remaining > 0 {
+			fmt.Printf("⏳ %d connections still open after %v, closing them\n", remaining, *drainTimeout)
+			closeAllConnections(closeReasonDraining)
+		}
+		fmt.Println("👋 Drain complete, shutting down")
+	} else {
+		fmt.Println("🛑 Listener closed, shutting down")
+	}
+
+	if err := runShutdownHooks(*hookTimeout); err != nil {
+		log.Printf("Shutdown hooks failed: %v", err)
+	}
+}
+
+// newTransport wraps udpConn in the server's Transport. Listening through
+// our own Transport lets us trace packets that don't belong to any
+// connection, and give each connection attempt its context.
+func newTransport(udpConn net.PacketConn) *quic.Transport {
+	return &quic.Transport{
+		Conn:               udpConn,
+		ConnectionIDLength: *connIDLength,
+		Tracer:             newTransportTracer(),
+		// Remember when each connection attempt started, before its handshake
+		ConnContext: func(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+			ctx = context.WithValue(ctx, handshakeStartKey{}, time.Now())
+			if *overhead {
+				ctx = context.WithValue(ctx, wireStatsKey{}, &wireStats{})
+			}
+			if *metricsAddr != "" {
+				ctx = context.WithValue(ctx, flowStatsKey{}, newFlowStats())
+			}
+			if *linger > 0 {
+				ctx = context.WithValue(ctx, deliveryKey{}, newDeliveryTracker())
+			}
+			if handshakes != nil {
+				slot := &handshakeSlot{limiter: handshakes}
+				ctx = context.WithValue(ctx, handshakeSlotKey{}, slot)
+				// The context ends when the handshake fails or the connection closes
+				context.AfterFunc(ctx, slot.Release)
+			}
+			return ctx, nil
+		},
+	}
+}
+
+// serveConnection logs a newly accepted connection and hands it to
+// handleConnection, unless it speaks a QUIC version older than minVersion
+func serveConnection(conn *quic.Conn, minVersion quic.Version) {
+	// Accept only returns connections whose handshake has completed
+	if slot, ok := conn.Context().Value(handshakeSlotKey{}).(*handshakeSlot); ok {
+		slot.Release()
+	}
+	if start, ok := conn.Context().Value(handshakeStartKey{}).(time.Time); ok {
+		elapsed := time.Since(start)
+		handshakeDuration.Observe(elapsed.Seconds())
+		fmt.Printf("🔗 New connection from %s (handshake took %v)\n", conn.RemoteAddr(), elapsed)
+	} else {
+		fmt.Printf("🔗 New connection from %s\n", conn.RemoteAddr())
+	}
+	if peerCerts := conn.ConnectionState().TLS.PeerCertificates; len(peerCerts) > 0 {
+		fmt.Printf("🪪 Client certificate: %s\n", peerCerts[0].Subject)
+	}
+
+	// Unlike leaving a version out of -versions, which makes clients fail
+	// version negotiation without saying why, this tells them
+	if version := conn.ConnectionState().Version; minVersion != 0 && versionAge(version) < versionAge(minVersion) {
+		fmt.Printf("🔒 Closing the connection from %s: it speaks QUIC %v, we require %v or newer\n", conn.RemoteAddr(), version, minVersion)
+		conn.CloseWithError(errorCodeVersionTooOld, fmt.Sprintf("QUIC %v or newer required", minVersion))
+		return
+	}
+
+	// Handle connection in a goroutine
+	go handleConnection(conn)
+}
+
+// Shutdown hooks, run in registration order once the server has stopped
+// serving
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func(context.Context) error
+)
+
+// RegisterShutdownHook adds a hook to run at shutdown, after every hook
+// registered before it. The hook's context expires after -shutdown-hook-timeout.
+func RegisterShutdownHook(hook func(ctx context.Context) error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// runShutdownHooks runs every registered hook in order, each with its own
+// timeout, and returns all of their errors joined together. A hook that
+// overruns its timeout is reported and left behind so the rest still run.
+func runShutdownHooks(timeout time.Duration) error {
+	shutdownMu.Lock()
+	hooks := slices.Clone(shutdownHooks)
+	shutdownMu.Unlock()
+
+	var errs []error
+	for i, hook := range hooks {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		done := make(chan error, 1)
+		go func() { done <- hook(ctx) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				errs = append(errs, fmt.Errorf("shutdown hook %d: %w", i+1, err))
+			}
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("shutdown hook %d: gave up after %v", i+1, timeout))
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// printFinalStats is a shutdown hook that prints the metrics a run
+// collected, so they aren't lost along with the metrics endpoint
+func printFinalStats(context.Context) error {
+	fmt.Printf("📈 Final stats: cache_hits=%s cache_misses=%s handshake_aborts=%s dropped_packets=%s flow_control_blocked=%s\n",
+		cacheHits, cacheMisses, handshakeAborts, droppedPackets, flowBlocked)
+	return nil
+}
+
+// acceptConnections serves every connection the listener accepts until it
+// is closed
+func acceptConnections(listener *quic.Listener, minVersion quic.Version) {
+	for {
+		// Accept a QUIC connection
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if isListenerClosed(err) {
+				return
+			}
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+		serveConnection(conn, minVersion)
+	}
+}
+
+// isListenerClosed reports whether an Accept error means the listener, or
+// the transport under it, was closed on purpose and no more connections
+// will come, as opposed to a failure worth logging
+func isListenerClosed(err error) bool {
+	return errors.Is(err, quic.ErrServerClosed) || errors.Is(err, quic.ErrTransportClosed)
+}
+
+// selftest starts the echo server in-process on a random local port, with
+// the server's TLS and QUIC configuration, runs a few checks against it
+// over real QUIC and reports each one. It returns whether all of them
+// passed.
+func selftest(tlsConf *tls.Config, quicConf *quic.Config, minVersion quic.Version) bool {
+	// These change what a plain echo, or ten of them at once, gets back
+	var unsupported []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"-number-lines", *numberLines},
+		{"-digest", *digestInput},
+		{"-transform", echoTransform != nil},
+		{"-canned-response", canned != nil},
+		{"-single-stream", *singleStream},
+		{"-client-ca", *clientCA != ""},
+	} {
+		if f.set {
+			unsupported = append(unsupported, f.name)
+		}
+	}
+	if len(unsupported) > 0 {
+		fmt.Printf("❌ The self-test checks the plain echo, run it without %s\n", strings.Join(unsupported, ", "))
+		return false
+	}
+
+	// The datagram check needs datagrams on both sides, -datagram-ack or not
+	quicConf = quicConf.Clone()
+	quicConf.EnableDatagrams = true
+
+	udpConn, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("❌ Failed to start the server: %v\n", err)
+		return false
+	}
+	transport := newTransport(udpConn)
+	defer transport.Close()
+	listener, err := transport.Listen(tlsConf, quicConf)
+	if err != nil {
+		fmt.Printf("❌ Failed to start the server: %v\n", err)
+		return false
+	}
+	defer listener.Close()
+	go acceptConnections(listener, minVersion)
+
+	// Offer only the versions -min-version lets through
+	var versions []quic.Version
+	for _, v := range quicConf.Versions {
+		if minVersion == 0 || versionAge(v) >= versionAge(minVersion) {
+			versions = append(versions, v)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientTLS := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnProtocol}}
+	conn, err := quic.DialAddr(ctx, listener.Addr().String(), clientTLS, &quic.Config{Versions: versions, EnableDatagrams: true})
+	if err != nil {
+		fmt.Printf("❌ Failed to connect: %v\n", err)
+		return false
+	}
+	defer func() {
+		conn.CloseWithError(0, "selftest done")
+		// Let the server see the close before its transport goes away
+		waitForDisconnects(time.Second)
+	}()
+
+	checks := []struct {
+		name string
+		run  func(context.Context, *quic.Conn) error
+	}{
+		{"echo", checkEcho},
+		{"echo at -max-buffer", checkLargeEcho},
+		{"concurrent streams", checkConcurrentEchoes},
+		{"oversized payload is reset", checkOversizedReset},
+		{"datagram is acknowledged", checkDatagram},
+	}
+	failed := 0
+	for _, check := range checks {
+		if err := check.run(ctx, conn); err != nil {
+			fmt.Printf("❌ Self-test %s: %v\n", check.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("✅ Self-test %s\n", check.name)
+	}
+	if failed > 0 {
+		fmt.Printf("❌ %d of %d self-test checks failed\n", failed, len(checks))
+		return false
+	}
+	fmt.Printf("🎉 All %d self-test checks passed\n", len(checks))
+	return true
+}
+
+// handshakeBench implements the handshake-bench subcommand: it measures how
+// many full handshakes per second an in-process server completes with an
+// RSA and with an ECDSA certificate, to show what -key-type ecdsa saves.
+// Client and server share the CPU, so the numbers compare the key types
+// rather than predict a real server's capacity.
+func handshakeBench(args []string, versions []quic.Version) error {
+	fs := flag.NewFlagSet("handshake-bench", flag.ExitOnError)
+	count := fs.Int("n", 200, "handshakes per key type")
+	parallel := fs.Int("parallel", 1, "handshakes in flight at once")
+	fs.Parse(args)
+
+	parallelism := max(*parallel, 1)
+	rates := make(map[string]float64)
+	for _, keyType := range []string{"rsa", "ecdsa"} {
+		elapsed, err := benchKeyType(keyType, *count, parallelism, versions)
+		if err != nil {
+			return fmt.Errorf("%s: %w", keyType, err)
+		}
+		rates[keyType] = float64(*count) / elapsed.Seconds()
+		fmt.Printf("🏁 %s: %d handshakes in %v, %.0f per second, %v each with %d in flight\n",
+			strings.ToUpper(keyType), *count, elapsed.Round(time.Millisecond), rates[keyType], (elapsed * time.Duration(parallelism) / time.Duration(*count)).Round(time.Microsecond), parallelism)
+	}
+	fmt.Printf("🏁 ECDSA completed %.1fx as many handshakes per second as RSA\n", rates["ecdsa"]/rates["rsa"])
+	return nil
+}
+
+// benchKeyType runs count handshakes against a server with a keyType
+// certificate and returns how long they took, setup not included
+func benchKeyType(keyType string, count, parallel int, versions []quic.Version) (time.Duration, error) {
+	certPEM, keyPEM, err := generateCertificate([]string{"localhost", "127.0.0.1"}, time.Hour, keyType)
+	if err != nil {
+		return 0, err
+	}
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return 0, err
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{tlsCert}, NextProtos: []string{alpnProtocol}}
+	quicConf := &quic.Config{Versions: versions}
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverTLS, quicConf)
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conn.CloseWithError(0, "handshake done")
+		}
+	}()
+
+	// Without a session cache every handshake is a full one, signature included
+	clientTLS := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnProtocol}}
+	jobs := make(chan struct{}, count)
+	for range count {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	start := time.Now()
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				conn, err := quic.DialAddr(ctx, listener.Addr().String(), clientTLS, quicConf)
+				cancel()
+				if err != nil {
+					errMu.Lock()
+					firstErr = cmp.Or(firstErr, err)
+					errMu.Unlock()
+					continue
+				}
+				conn.CloseWithError(0, "handshake done")
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if firstErr != nil {
+		return 0, fmt.Errorf("handshake failed: %w", firstErr)
+	}
+	return elapsed, nil
+}
+
+// roundTrip sends request on a new stream and returns the whole response
+func roundTrip(ctx context.Context, conn *quic.Conn, request []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(request); err != nil {
+		return nil, err
+	}
+	stream.Close()
+	return io.ReadAll(stream)
+}
+
+// expectEcho checks that request comes back with the echo prefix
+func expectEcho(ctx context.Context, conn *quic.Conn, request []byte) error {
+	response, err := roundTrip(ctx, conn, request)
+	if err != nil {
+		return err
+	}
+	if want := fmt.Appendf(nil, "Echo: %s", request); !bytes.Equal(response, want) {
+		return fmt.Errorf("got %d bytes back, want %d bytes of echo", len(response), len(want))
+	}
+	return nil
+}
+
+func checkEcho(ctx context.Context, conn *quic.Conn) error {
+	return expectEcho(ctx, conn, []byte("Hello from the self-test!"))
+}
+
+// checkLargeEcho sends the largest accepted request, which spans many packets
+func checkLargeEcho(ctx context.Context, conn *quic.Conn) error {
+	return expectEcho(ctx, conn, bytes.Repeat([]byte("q"), *maxBuffer))
+}
+
+func checkConcurrentEchoes(ctx context.Context, conn *quic.Conn) error {
+	errs := make([]error, 10)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = expectEcho(ctx, conn, fmt.Appendf(nil, "concurrent stream %d", i))
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// checkOversizedReset expects a request over -max-buffer to be reset with
+// errorCodePayloadTooLarge rather than answered
+func checkOversizedReset(ctx context.Context, conn *quic.Conn) error {
+	_, err := roundTrip(ctx, conn, bytes.Repeat([]byte("q"), *maxBuffer+1))
+	var streamErr *quic.StreamError
+	if !errors.As(err, &streamErr) || streamErr.ErrorCode != errorCodePayloadTooLarge {
+		return fmt.Errorf("want a reset with code %#x, got %v", errorCodePayloadTooLarge, err)
+	}
+	return nil
+}
+
+// checkDatagram sends numbered datagrams until the server acknowledges one
+// of them. Datagrams aren't retransmitted, so even on loopback the first
+// few may be lost.
+func checkDatagram(ctx context.Context, conn *quic.Conn) error {
+	if !conn.ConnectionState().SupportsDatagrams {
+		return errors.New("datagrams weren't negotiated")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	acks := make(chan uint64, 1)
+	go func() {
+		for {
+			ack, err := conn.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			if len(ack) == 8 {
+				select {
+				case acks <- binary.BigEndian.Uint64(ack):
+				default:
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for seq := uint64(1); ; seq++ {
+		if err := conn.SendDatagram(fmt.Appendf(binary.BigEndian.AppendUint64(nil, seq), " self-test datagram %d", seq)); err != nil {
+			return err
+		}
+		select {
+		case ack := <-acks:
+			if ack == 0 || ack > seq {
+				return fmt.Errorf("acknowledgment for datagram %d, but only %d were sent", ack, seq)
+			}
+			return nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("none of %d datagrams was acknowledged", seq)
+		}
+	}
+}
+
+func handleConnection(conn *quic.Conn) {
+	defer conn.CloseWithError(0, closeReasonDone)
+
+	state := newConnState(conn)
+	defer state.idle.stop()
+	defer state.clearSession()
+	if state.wire != nil {
+		defer state.wire.report(os.Stdout, conn.RemoteAddr())
+	}
+	// Negotiated only with -datagram-ack, or by the self-test
+	if conn.ConnectionState().SupportsDatagrams {
+		go acknowledgeDatagrams(conn)
+	}
+	if !admit(state) {
+		return
+	}
+	defer func() {
+		connsMu.Lock()
+		delete(conns, state)
+		connsMu.Unlock()
+	}()
+	// Reported while the connection still counts as open
+	defer state.reportSuppressedErrors()
+
+	for {
+		// Accept a stream from the client
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			var appErr *quic.ApplicationError
+			if errors.As(err, &appErr) && appErr.Remote {
+				fmt.Printf("👋 Client %s closed the connection: %q (code %d)\n", conn.RemoteAddr(), appErr.ErrorMessage, appErr.ErrorCode)
+				return
+			}
+			// We closed it ourselves, e.g. at the end of a drain
+			if appErr != nil {
+				debugf("👋 Closed the connection to %s: %q\n", conn.RemoteAddr(), appErr.ErrorMessage)
+				return
+			}
+			fmt.Printf("❌ Connection closed: %v\n", err)
+			return
+		}
+
+		fmt.Printf("📋 New stream %d opened\n", stream.StreamID())
+
+		if *singleStream {
+			if !state.streamActive.CompareAndSwap(false, true) {
+				state.logError("🚫 Refusing stream %d, another stream on this connection is still active\n", stream.StreamID())
+				resetStream(stream, errorCodeSingleStream)
+				continue
+			}
+			// The stream's context ends once we've closed or reset our side
+			context.AfterFunc(stream.Context(), func() { state.streamActive.Store(false) })
+		}
+
+		if !trackStream() {
+			fmt.Printf("🚰 Refusing stream %d, server is draining\n", stream.StreamID())
+			resetStream(stream, errorCodeDraining)
+			continue
+		}
+
+		// Handle stream in goroutine
+		state.idle.streamStarted()
+		state.streams.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer state.streams.Add(-1)
+			defer state.idle.streamEnded()
+			handleStream(state, stream)
+		}()
+	}
+}
+
+// acknowledgeDatagrams answers every datagram from the client with one
+// carrying the same leading 8-byte sequence number. Datagrams are never
+// retransmitted, so these acknowledgments are the only way for the client
+// to tell which ones arrived.
+func acknowledgeDatagrams(conn *quic.Conn) {
+	for {
+		datagram, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return
+		}
+		if len(datagram) < 8 {
+			debugf("📮 Ignoring a %d-byte datagram without a sequence number\n", len(datagram))
+			continue
+		}
+		if err := conn.SendDatagram(datagram[:8]); err != nil {
+			debugf("📮 Failed to acknowledge datagram %d: %v\n", binary.BigEndian.Uint64(datagram), err)
+		}
+	}
+}
+
+// trackStream registers a new in-flight stream. It returns false once the
+// server is draining and shouldn't take on new work.
+func trackStream() bool {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if draining {
+		return false
+	}
+	inflight.Add(1)
+	return true
+}
+
+func isDraining() bool {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	return draining
+}
+
+// startDrain stops the server from accepting new connections and streams;
+// main then waits for in-flight streams before exiting
+func startDrain(listener *quic.Listener) {
+	drainMu.Lock()
+	draining = true
+	drainMu.Unlock()
+	listener.Close()
+}
+
+// watchDrainFile polls for path and starts a drain once it exists, so
+// orchestration can signal shutdown through a shared filesystem
+func watchDrainFile(path string, interval time.Duration, listener *quic.Listener) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Printf("🚰 Found drain file %s\n", path)
+			startDrain(listener)
+			return
+		}
+	}
+}
+
+// waitForDisconnects waits up to timeout for all clients to close their
+// connections and returns how many are still open
+func waitForDisconnects(timeout time.Duration) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		connsMu.Lock()
+		remaining := len(conns)
+		connsMu.Unlock()
+		if remaining == 0 {
+			return 0
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return remaining
+		}
+	}
+}
+
+// dumpOnSignal prints diagnostics every time the server receives SIGQUIT
+// (Ctrl+\ in a terminal), to see what a server that seems stuck is up to
+// without attaching a debugger. It replaces Go's default for SIGQUIT,
+// which prints every stack and exits; the server keeps running.
+func dumpOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGQUIT)
+	for range signals {
+		printDiagnostics(os.Stdout)
+	}
+}
+
+// printDiagnostics writes the number of open connections, the streams
+// being answered on each and the number of goroutines, and with
+// -dump-stacks the stacks of all goroutines, grouped by stack
+func printDiagnostics(w io.Writer) {
+	connsMu.Lock()
+	states := make([]*connState, 0, len(conns))
+	for state := range conns {
+		states = append(states, state)
+	}
+	connsMu.Unlock()
+	slices.SortFunc(states, func(a, b *connState) int {
+		return strings.Compare(a.RemoteAddr().String(), b.RemoteAddr().String())
+	})
+
+	streams := 0
+	for _, state := range states {
+		streams += int(state.streams.Load())
+	}
+	fmt.Fprintf(w, "🩺 %d connections, %d streams in flight, %d goroutines\n", len(states), streams, runtime.NumGoroutine())
+	for _, state := range states {
+		fmt.Fprintf(w, "   %s: %d streams\n", state.RemoteAddr(), state.streams.Load())
+	}
+	if isDraining() {
+		fmt.Fprintln(w, "   Draining")
+	}
+	if *dumpStacks {
+		pprof.Lookup("goroutine").WriteTo(w, 1)
+	}
+}
+
+// listenUDP binds a UDP socket to addr
+func listenUDP(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", udpAddr)
+}
+
+// listenWithFallback binds addr, or fallback when addr can't be bound and
+// fallback is set
+func listenWithFallback(addr, fallback string) (*net.UDPConn, error) {
+	udpConn, err := listenUDP(addr)
+	if err != nil && fallback != "" {
+		fmt.Printf("⚠️  Can't listen on %s (%v), falling back to %s\n", addr, err, fallback)
+		udpConn, err = listenUDP(fallback)
+	}
+	return udpConn, err
+}
+
+// closeAllConnections closes every open connection with the given reason
+func closeAllConnections(reason string) {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	for state := range conns {
+		state.CloseWithError(0, reason)
+	}
+}
+
+// priorityClass ranks connections for shedding under -max-conns
+type priorityClass int
+
+const (
+	priorityLow priorityClass = iota
+	priorityHigh
+)
+
+func (p priorityClass) String() string {
+	if p == priorityHigh {
+		return "high"
+	}
+	return "low"
+}
+
+// connPriority derives a connection's class from its client certificate:
+// high if the certificate's common name or one of its organizational units
+// is listed in -high-priority, low otherwise, certificate or not
+func connPriority(peerCerts []*x509.Certificate) priorityClass {
+	if len(peerCerts) == 0 {
+		return priorityLow
+	}
+	subject := peerCerts[0].Subject
+	if highPriorityNames[subject.CommonName] || slices.ContainsFunc(subject.OrganizationalUnit, func(ou string) bool { return highPriorityNames[ou] }) {
+		return priorityHigh
+	}
+	return priorityLow
+}
+
+// admit adds a new connection to conns and reports whether it may stay. At
+// -max-conns it makes room by closing the connection shedVictim picks, or
+// closes the new one if there is nothing to shed for it.
+func admit(state *connState) bool {
+	debugf("🏷️  Connection from %s is %v priority\n", state.RemoteAddr(), state.priority)
+	connsMu.Lock()
+	var victim *connState
+	if *maxConns > 0 && len(conns) >= *maxConns {
+		victim = shedVictim(conns, state)
+		if victim == nil {
+			open := len(conns)
+			connsMu.Unlock()
+			connsShed.Add(state.priority.String(), 1)
+			fmt.Printf("🏷️  Refusing the %v-priority connection from %s: %d connections open, none of lower priority\n", state.priority, state.RemoteAddr(), open)
+			state.CloseWithError(errorCodeShed, closeReasonFull)
+			return false
+		}
+		// Removed now so the next newcomer doesn't pick it again
+		delete(conns, victim)
+	}
+	conns[state] = struct{}{}
+	connsMu.Unlock()
+
+	if victim != nil {
+		connsShed.Add(victim.priority.String(), 1)
+		fmt.Printf("🏷️  Shedding the %v-priority connection from %s to admit a %v-priority one from %s\n", victim.priority, victim.RemoteAddr(), state.priority, state.RemoteAddr())
+		victim.CloseWithError(errorCodeShed, closeReasonShed)
+	}
+	return true
+}
+
+// shedVictim picks the connection to close so newcomer fits under
+// -max-conns: the most recently opened of the lowest-priority ones, as it
+// has the least invested in it. Only a connection of lower priority than
+// newcomer qualifies, so a server full of equals refuses newcomers rather
+// than trading one for another; shedVictim returns nil then.
+func shedVictim(open map[*connState]struct{}, newcomer *connState) *connState {
+	var victim *connState
+	for c := range open {
+		if c.priority >= newcomer.priority {
+			continue
+		}
+		if victim == nil || c.priority < victim.priority || (c.priority == victim.priority && c.opened.After(victim.opened)) {
+			victim = c
+		}
+	}
+	return victim
+}
+
+// handleStream answers one request. Every way out of it ends our side of the
+// stream exactly once, either through lingerForAck or through failStream.
+func handleStream(state *connState, stream *quic.Stream) {
+	// Follow the ACKs for everything we write to this stream for -linger
+	delivered := state.delivery.watch(stream.StreamID())
+	defer state.delivery.forget(stream.StreamID())
+
+	// Bound the whole handler, from the first read to the last write
+	ctx := stream.Context()
+	var deadline time.Time
+	if *handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		deadline = time.Now().Add(*handlerTimeout)
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+		stream.SetDeadline(deadline)
+	}
+
+	// A slow but steady client may take as long as it needs, a stalled one may not
+	input := &progressReader{stream: stream, timeout: *progressTimeout, limit: deadline}
+	out := newStreamOutput(state, stream)
+	fmt.Printf("🆔 Request %s is stream %d from %s\n", out.id, stream.StreamID(), state.RemoteAddr())
+
+	// Line numbering answers each line as it arrives instead of buffering
+	if *numberLines {
+		if err := echoNumberedLines(state, out, input, *maxBuffer); err != nil {
+			failStream(state, out, err, "numbering lines")
+			return
+		}
+		lingerForAck(state, out, delivered)
+		return
+	}
+
+	// A digest never holds more than one read of the input, however large
+	if *digestInput {
+		if err := answerDigest(state, out, input); err != nil {
+			failStream(state, out, err, "digesting")
+			return
+		}
+		lingerForAck(state, out, delivered)
+		return
+	}
+
+	// Read everything the client sends until it closes its write side
+	buffer := newStreamBuffer(*maxBuffer)
+	if err := buffer.Fill(state.requestBody(input)); err != nil {
+		failStream(state, out, err, "reading")
+		return
+	}
+
+	message := string(buffer.Bytes())
+	fmt.Printf("📨 Received [%s]: %s\n", out.id, message)
+	state.countPayload(buffer.Len(), 0)
+
+	// Session values survive across streams of the same connection
+	requests := state.UpdateSession("requests", func(old any, _ bool) any {
+		count, _ := old.(int)
+		return count + 1
+	})
+	fmt.Printf("🗂️  Request %d on this connection\n", requests)
+
+	// Hold the response back to simulate variable latency, cached or not
+	if responseJitter != nil {
+		delay, err := responseJitter.Sleep(ctx)
+		if err != nil {
+			failStream(state, out, err, "delaying the response")
+			return
+		}
+		fmt.Printf("⏳ Delayed response by %v\n", delay)
+	}
+
+	// Identical requests can be answered from the cache without processing
+	var response []byte
+	key := sha256.Sum256(buffer.Bytes())
+	cached := false
+	if responses != nil {
+		response, cached = responses.Get(key)
+	}
+	if cached {
+		cacheHits.Add(1)
+		fmt.Println("💾 Serving cached response")
+	} else {
+		var err error
+		response, err = processRequest(ctx, buffer.Bytes())
+		if err != nil {
+			failStream(state, out, err, "processing")
+			return
+		}
+		if responses != nil {
+			cacheMisses.Add(1)
+			responses.Put(key, response)
+		}
+	}
+
+	n, err := out.Write(response)
+	state.countPayload(0, n)
+	if err != nil {
+		failStream(state, out, err, "writing")
+		return
+	}
+
+	fmt.Printf("📤 Sent [%s]: %s\n", out.id, response)
+	lingerForAck(state, out, delivered)
+}
+
+// lingerForAck closes the write side of a stream after a successful
+// response. With -linger it then waits until the client has acknowledged
+// the whole response, the connection closes or the linger time runs out.
+func lingerForAck(state *connState, out *streamOutput, delivered <-chan struct{}) {
+	stream := out.stream
+	if err := out.Close(); err != nil {
+		failStream(state, out, err, "finishing the response")
+		return
+	}
+	if delivered == nil {
+		return
+	}
+	start := time.Now()
+	timer := time.NewTimer(*linger)
+	defer timer.Stop()
+	select {
+	case <-delivered:
+		debugf("📬 Client acknowledged all of stream %d [%s] after %v\n", stream.StreamID(), out.id, time.Since(start))
+	case <-state.Context().Done():
+	case <-timer.C:
+		fmt.Printf("⌛ Client still hasn't acknowledged all of stream %d [%s] after %v\n", stream.StreamID(), out.id, *linger)
+	}
+}
+
+// processRequest computes the response to a request. This is the part of
+// the handler that -cache-size memoizes.
+func processRequest(ctx context.Context, request []byte) ([]byte, error) {
+	// A canned response doesn't depend on the request at all
+	if canned != nil {
+		return canned, nil
+	}
+
+	if echoTransform != nil {
+		var err error
+		if request, err = echoTransform(request); err != nil {
+			return nil, err
+		}
+	}
+
+	// Echo back with a prefix
+	return fmt.Appendf(nil, "Echo: %s", request), nil
+}
+
+// transform rewrites an echoed payload. It returns a new slice rather than
+// modifying its input, which still belongs to the caller.
+type transform func([]byte) ([]byte, error)
+
+// transforms are the stages -transform can chain, by name
+var transforms = map[string]transform{
+	"upper": func(p []byte) ([]byte, error) { return bytes.ToUpper(p), nil },
+	"lower": func(p []byte) ([]byte, error) { return bytes.ToLower(p), nil },
+	"reverse": func(p []byte) ([]byte, error) {
+		// Reverse runes rather than bytes so UTF-8 text stays valid
+		runes := bytes.Runes(p)
+		slices.Reverse(runes)
+		return []byte(string(runes)), nil
+	},
+	"compress": func(p []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(p); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	"base64": func(p []byte) ([]byte, error) {
+		return base64.StdEncoding.AppendEncode(nil, p), nil
+	},
+}
+
+func transformNames() []string {
+	return slices.Sorted(maps.Keys(transforms))
+}
+
+// parseTransforms turns a comma-separated list of transform names into a
+// single transform that applies them in order, so "upper,reverse" upper-
+// cases the payload and then reverses it.
+func parseTransforms(spec string) (transform, error) {
+	var stages []transform
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		stage, ok := transforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q in -transform, want one of %s", name, strings.Join(transformNames(), ", "))
+		}
+		stages = append(stages, stage)
+	}
+	return func(p []byte) ([]byte, error) {
+		for _, stage := range stages {
+			var err error
+			if p, err = stage(p); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}, nil
+}
+
+// echoNumberedLines echoes newline-delimited input read from the stream with
+// every line prefixed by its number, like cat -n. The count starts at 1 for
+// each stream, and a final line without a trailing newline is numbered too
+// when the stream ends cleanly; one cut short by an error is dropped.
+// With -line-timeout a line must be finished within that long of its first
+// byte arriving; the wait for a line to start is not limited.
+func echoNumberedLines(state *connState, out *streamOutput, input *progressReader, maxLine int) error {
+	stream := out.stream
+	reader := bufio.NewReader(state.requestBody(input))
+	delay := writeCoalesceDelay
+	if *nodelay {
+		delay = 0
+	}
+	writer := newCoalescingWriter(out, delay)
+	defer writer.Stop()
+
+	lines := 0
+	for {
+		if *lineTimeout > 0 {
+			input.line = time.Time{}
+			if _, err := reader.Peek(1); err == nil {
+				input.line = time.Now().Add(*lineTimeout)
+			}
+		}
+		line, err := readLine(reader, maxLine)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) > 0 {
+			lines++
+			n, werr := fmt.Fprintf(writer, "%6d\t%s", lines, line)
+			state.countPayload(len(line), n)
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			fmt.Printf("🔢 Numbered %d lines on stream %d [%s]\n", lines, stream.StreamID(), out.id)
+			return writer.Flush()
+		}
+	}
+}
+
+// answerDigest reads the stream to its end, counting bytes, lines and words
+// and hashing the data as each read arrives, and answers with the totals.
+// Unlike the echo it buffers nothing, so -max-buffer doesn't apply.
+func answerDigest(state *connState, out *streamOutput, input io.Reader) error {
+	var counts inputCounts
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(&counts, hash), state.requestBody(input))
+	state.countPayload(int(n), 0)
+	if err != nil {
+		return err
+	}
+
+	response := fmt.Appendf(nil, "Digest: %d bytes, %d lines, %d words, sha256 %x", counts.bytes, counts.lines, counts.words, hash.Sum(nil))
+	fmt.Printf("🧮 Digested stream %d [%s]: %s\n", out.stream.StreamID(), out.id, response)
+	written, err := out.Write(response)
+	state.countPayload(0, written)
+	return err
+}
+
+// inputCounts counts bytes, newlines and words like wc, as an io.Writer
+// so the input can be counted one chunk at a time. A word is a run of
+// non-space bytes, and one split across two chunks counts once.
+type inputCounts struct {
+	bytes, lines, words int64
+	inWord              bool
+}
+
+func (c *inputCounts) Write(p []byte) (int, error) {
+	c.bytes += int64(len(p))
+	for _, b := range p {
+		if b == '\n' {
+			c.lines++
+		}
+		space := b == ' ' || b == '\n' || b == '\t' || b == '\r' || b == '\v' || b == '\f'
+		if !space && !c.inWord {
+			c.words++
+		}
+		c.inWord = !space
+	}
+	return len(p), nil
+}
+
+// coalescingWriter holds small writes back for up to delay, or until
+// writeCoalesceSize bytes have piled up, and sends them to the stream in
+// one go. Like Nagle's algorithm in TCP this trades latency for fewer,
+// fuller packets. With a zero delay every write goes straight through.
+type coalescingWriter struct {
+	out   io.Writer
+	delay time.Duration
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	err   error // from a flush the timer ran, reported by the next call
+}
+
+func newCoalescingWriter(out io.Writer, delay time.Duration) *coalescingWriter {
+	return &coalescingWriter{out: out, delay: delay}
+}
+
+func (w *coalescingWriter) Write(p []byte) (int, error) {
+	if w.delay == 0 {
+		return w.out.Write(p)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= writeCoalesceSize {
+		return len(p), w.flushLocked()
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.err = w.flushLocked()
+		})
+	}
+	return len(p), nil
+}
+
+// Flush sends whatever is held back; call it before closing the stream
+func (w *coalescingWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flushLocked()
+}
+
+// Stop drops anything still held back, for when the stream is being abandoned
+func (w *coalescingWriter) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.buf = nil
+}
+
+func (w *coalescingWriter) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.out.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// streamOutput is where a handler writes its response. On a connection
+// that negotiated compression it deflates everything written to it,
+// flushing after every write so each response, or each numbered line, is
+// sent right away rather than once the compressor has a block's worth.
+type streamOutput struct {
+	stream *quic.Stream
+	id     string        // the request's own ID, logged with everything about the stream
+	zw     *flate.Writer // nil unless the connection negotiated alpnCompressed
+}
+
+func newStreamOutput(state *connState, stream *quic.Stream) *streamOutput {
+	out := &streamOutput{stream: stream, id: newRequestID()}
+	if state.compressed {
+		// Only invalid compression levels fail
+		out.zw, _ = flate.NewWriter(writerFunc(func(p []byte) (int, error) { return writeStream(stream, p) }), flate.DefaultCompression)
+	}
+	return out
+}
+
+// newRequestID returns a random version 4 UUID. Unlike stream IDs, which
+// start over on every connection, it tells requests apart across
+// reconnects.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Write returns len(p), not the compressed size, when all of p was sent
+func (o *streamOutput) Write(p []byte) (int, error) {
+	if o.zw == nil {
+		return writeStream(o.stream, p)
+	}
+	if _, err := o.zw.Write(p); err != nil {
+		return 0, err
+	}
+	if err := o.zw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the compressed data, if any, and closes our side of the stream
+func (o *streamOutput) Close() error {
+	if o.zw != nil {
+		if err := o.zw.Close(); err != nil {
+			return err
+		}
+	}
+	return o.stream.Close()
+}
+
+// writerFunc turns a function into an io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// writeStream writes p to the stream. Like stream.Write it blocks for as
+// long as flow control leaves no room, until the client reads enough to
+// raise its stream limit or, with many busy streams, its connection limit.
+// That is backpressure doing its job and no data is lost, but when it lasts
+// longer than -blocked-warning the client has probably stopped reading, so
+// say so, and say again once the write gets through.
+func writeStream(stream *quic.Stream, p []byte) (int, error) {
+	if *blockedWarning <= 0 {
+		return stream.Write(p)
+	}
+	start := time.Now()
+	timer := time.AfterFunc(*blockedWarning, func() {
+		fmt.Printf("⚠️  Writing to stream %d has been blocked for %v, waiting for the client to read and grant more flow control credit\n", stream.StreamID(), *blockedWarning)
+	})
+	n, err := stream.Write(p)
+	if !timer.Stop() {
+		fmt.Printf("🚧 Writing to stream %d was blocked for %v in total\n", stream.StreamID(), time.Since(start))
+	}
+	return n, err
+}
+
+// readLine reads up to and including the next newline, failing with
+// errPayloadTooLarge rather than buffering a line longer than limit.
+func readLine(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return nil, errPayloadTooLarge
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// failStream logs why a stream handler gave up and ends the stream: errors
+// the client should know about reset it with the matching error code, the
+// rest just close our side.
+func failStream(state *connState, out *streamOutput, err error, during string) {
+	stream := out.stream
+	switch {
+	case isPeerGone(err):
+		// Nothing to reset: the client closed the connection or abandoned the
+		// stream, both normal ways for it to end at the same time as ours
+		debugf("🔇 Client left stream %d [%s] while %s: %v\n", stream.StreamID(), out.id, during, err)
+		stream.Close()
+	case errors.Is(err, errPayloadTooLarge):
+		state.logError("❌ Stream %d [%s] exceeded %d buffered bytes while %s, resetting\n", stream.StreamID(), out.id, *maxBuffer, during)
+		resetStream(stream, errorCodePayloadTooLarge)
+	case errors.Is(err, errStalled):
+		state.logError("🐌 Stream %d [%s] stalled, nothing arrived for %v while %s, resetting\n", stream.StreamID(), out.id, *progressTimeout, during)
+		resetStream(stream, errorCodeStalled)
+	case errors.Is(err, errLineTimeout):
+		state.logError("✂️  Stream %d [%s] left a line unfinished for %v while %s, resetting\n", stream.StreamID(), out.id, *lineTimeout, during)
+		resetStream(stream, errorCodeLineTimeout)
+	case isHandlerTimeout(err):
+		state.logError("⏰ Stream %d [%s] exceeded the %v handler timeout while %s, resetting\n", stream.StreamID(), out.id, *handlerTimeout, during)
+		resetStream(stream, errorCodeHandlerTimeout)
+	default:
+		state.logError("❌ Stream %d [%s] failed while %s: %v\n", stream.StreamID(), out.id, during, err)
+		stream.Close()
+	}
+}
+
+// isPeerGone reports whether err means the client closed the connection,
+// canceled the stream or vanished, which is routine rather than a failure
+func isPeerGone(err error) bool {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote {
+		return true
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) && streamErr.Remote {
+		return true
+	}
+	var idleErr *quic.IdleTimeoutError
+	return errors.As(err, &idleErr)
+}
+
+// debugf prints only when -debug is set
+func debugf(format string, args ...any) {
+	if *debug {
+		fmt.Printf(format, args...)
+	}
+}
+
+// resetStream aborts both directions of a stream with the given error code
+func resetStream(stream *quic.Stream, code quic.StreamErrorCode) {
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
+}
+
+// isHandlerTimeout reports whether err means the -handler-timeout budget ran out
+func isHandlerTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// newTransportTracer logs events that happen before a connection exists,
+// such as clients asking for a QUIC version we don't speak.
+func newTransportTracer() *logging.Tracer {
+	return &logging.Tracer{
+		SentVersionNegotiationPacket: func(dest net.Addr, _, _ logging.ArbitraryLenConnectionID, versions []logging.Version) {
+			fmt.Printf("🔀 Client %s requested an unsupported version, sent version negotiation offering %v\n", dest, versions)
+		},
+		// quic-go discards malformed packets before they reach a connection;
+		// a burst of these usually means someone is scanning or fuzzing us
+		DroppedPacket: func(addr net.Addr, _ logging.PacketType, size logging.ByteCount, reason logging.PacketDropReason) {
+			if name, suspicious := countDrop(reason); suspicious {
+				fmt.Printf("🛡️  Dropped a %d-byte packet from %s: %s\n", size, addr, name)
+			}
+		},
+	}
+}
+
+// countDrop counts a dropped packet in the metrics by its reason, and
+// returns the reason's name and whether the drop is worth logging
+func countDrop(reason logging.PacketDropReason) (name string, suspicious bool) {
+	drop, ok := dropReasons[reason]
+	if !ok {
+		drop.name = fmt.Sprintf("reason_%d", reason)
+	}
+	droppedPackets.Add(drop.name, 1)
+	return drop.name, drop.suspicious
+}
+
+// dropReasons names the reasons quic-go drops packets, and says whether a
+// drop is worth logging. Packets for connections that just closed, or that
+// arrive before their keys, are routine.
+var dropReasons = map[logging.PacketDropReason]struct {
+	name       string
+	suspicious bool
+}{
+	logging.PacketDropKeyUnavailable:               {"key_unavailable", false},
+	logging.PacketDropUnknownConnectionID:          {"unknown_connection_id", false},
+	logging.PacketDropHeaderParseError:             {"header_parse_error", true},
+	logging.PacketDropPayloadDecryptError:          {"payload_decrypt_error", true},
+	logging.PacketDropProtocolViolation:            {"protocol_violation", true},
+	logging.PacketDropDOSPrevention:                {"dos_prevention", true},
+	logging.PacketDropUnsupportedVersion:           {"unsupported_version", false},
+	logging.PacketDropUnexpectedPacket:             {"unexpected_packet", true},
+	logging.PacketDropUnexpectedSourceConnectionID: {"unexpected_source_connection_id", true},
+	logging.PacketDropUnexpectedVersion:            {"unexpected_version", true},
+	logging.PacketDropDuplicate:                    {"duplicate", false},
+}
+
+// newConnectionTracer logs the packet sizes each connection ends up using,
+// which differ per client depending on its configuration and the path
+func newConnectionTracer(ctx context.Context, _ logging.Perspective, connID logging.ConnectionID) *logging.ConnectionTracer {
+	// The server drops its handshake keys once the handshake is complete
+	handshakeDone := false
+	tracer := &logging.ConnectionTracer{
+		DroppedEncryptionLevel: func(encLevel logging.EncryptionLevel) {
+			if encLevel == logging.EncryptionHandshake {
+				handshakeDone = true
+			}
+		},
+		ClosedConnection: func(err error) {
+			if !handshakeDone {
+				logHandshakeAbort(connID, err)
+			}
+		},
+		// An initial that parses but doesn't decrypt gets as far as a new
+		// connection before it is dropped, so the transport never sees it
+		DroppedPacket: func(_ logging.PacketType, _ logging.PacketNumber, size logging.ByteCount, reason logging.PacketDropReason) {
+			if handshakeDone {
+				return
+			}
+			if name, suspicious := countDrop(reason); suspicious {
+				fmt.Printf("🛡️  [%s] Dropped a %d-byte packet during the handshake: %s\n", connID, size, name)
+			}
+		},
+		ReceivedTransportParameters: func(params *logging.TransportParameters) {
+			fmt.Printf("📏 [%s] Client accepts UDP payloads up to %d bytes\n", connID, params.MaxUDPPayloadSize)
+		},
+		UpdatedMTU: func(mtu logging.ByteCount, done bool) {
+			if done {
+				fmt.Printf("📏 [%s] Path MTU discovery settled on %d bytes\n", connID, mtu)
+			}
+		},
+	}
+
+	// Count every UDP payload in both directions for -overhead
+	if wire, ok := ctx.Value(wireStatsKey{}).(*wireStats); ok {
+		tracer.SentLongHeaderPacket = func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			wire.wireSent.Add(int64(size))
+			wire.packetsSent.Add(1)
+		}
+		tracer.SentShortHeaderPacket = func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			wire.wireSent.Add(int64(size))
+			wire.packetsSent.Add(1)
+		}
+		tracer.ReceivedLongHeaderPacket = func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			wire.wireReceived.Add(int64(size))
+		}
+		tracer.ReceivedShortHeaderPacket = func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			wire.wireReceived.Add(int64(size))
+		}
+	}
+
+	tracers := []*logging.ConnectionTracer{tracer}
+	// Follow stream ACKs for -linger
+	if delivery, ok := ctx.Value(deliveryKey{}).(*deliveryTracker); ok {
+		tracers = append(tracers, delivery.tracer())
+	}
+	// Follow the client's flow control limits for the metrics
+	if flow, ok := ctx.Value(flowStatsKey{}).(*flowStats); ok {
+		tracers = append(tracers, flow.tracer(connID))
+	}
+	return logging.NewMultiplexedConnectionTracer(tracers...)
+}
+
+// flowStats follows the flow control windows the client grants the server,
+// for the connection and for each stream, to show whether they are what
+// limits a large transfer. quic-go doesn't expose its flow controllers, so
+// this is rebuilt from the frames the tracer sees.
+type flowStats struct {
+	mu         sync.Mutex
+	connection flowWindow
+	streams    map[logging.StreamID]*flowWindow
+	streamInit logging.ByteCount // initial limit for streams we didn't see yet
+}
+
+// flowWindow is one flow control limit and how much of it we've used
+type flowWindow struct {
+	sent   logging.ByteCount // highest offset sent; for the connection, the sum over streams
+	limit  logging.ByteCount // the client's latest MAX_DATA or MAX_STREAM_DATA
+	window logging.ByteCount // credit left right after the limit last moved
+}
+
+func newFlowStats() *flowStats {
+	return &flowStats{streams: make(map[logging.StreamID]*flowWindow)}
+}
+
+func (w *flowWindow) raise(limit logging.ByteCount) {
+	if limit > w.limit {
+		w.limit = limit
+		w.window = limit - w.sent
+	}
+}
+
+// utilization returns how much of the latest window has been used up, from
+// 0 (all of it still open) to 1 (blocked until the client grants more)
+func (w *flowWindow) utilization() float64 {
+	if w.window <= 0 {
+		return 0
+	}
+	used := w.window - (w.limit - w.sent)
+	return min(max(float64(used)/float64(w.window), 0), 1)
+}
+
+// stream returns the window of a stream, starting it at the initial limit
+func (f *flowStats) stream(id logging.StreamID) *flowWindow {
+	w, ok := f.streams[id]
+	if !ok {
+		w = &flowWindow{limit: f.streamInit, window: f.streamInit}
+		f.streams[id] = w
+	}
+	return w
+}
+
+// utilization returns the connection's utilization and the highest of its
+// streams'
+func (f *flowStats) utilization() (connection, stream float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, w := range f.streams {
+		stream = max(stream, w.utilization())
+	}
+	return f.connection.utilization(), stream
+}
+
+func (f *flowStats) tracer(connID logging.ConnectionID) *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		ReceivedTransportParameters: func(params *logging.TransportParameters) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.connection.raise(params.InitialMaxData)
+			// Streams are opened by the client, so they are local to it and its
+			// "local" limit is how much we may send on them
+			f.streamInit = params.InitialMaxStreamDataBidiLocal
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, frame := range frames {
+				switch frame := frame.(type) {
+				case *logging.MaxDataFrame:
+					f.connection.raise(frame.MaximumData)
+				case *logging.MaxStreamDataFrame:
+					f.stream(frame.StreamID).raise(frame.MaximumStreamData)
+				}
+			}
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, frames []logging.Frame) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, frame := range frames {
+				switch frame := frame.(type) {
+				case *logging.StreamFrame:
+					w := f.stream(frame.StreamID)
+					if end := frame.Offset + frame.Length; end > w.sent {
+						f.connection.sent += end - w.sent
+						w.sent = end
+					}
+				case *logging.DataBlockedFrame:
+					flowBlocked.Add("connection", 1)
+					fmt.Printf("🚧 [%s] Blocked by the client's connection flow control limit of %d bytes\n", connID, frame.MaximumData)
+				case *logging.StreamDataBlockedFrame:
+					flowBlocked.Add("stream", 1)
+					fmt.Printf("🚧 [%s] Stream %d blocked by the client's stream flow control limit of %d bytes\n", connID, frame.StreamID, frame.MaximumStreamData)
+				}
+			}
+		},
+	}
+}
+
+// sampleFlowControl publishes the flow control utilization every interval
+func sampleFlowControl(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		publishFlowUtilization()
+	}
+}
+
+// publishFlowUtilization sets the gauges to the highest connection and
+// stream flow control utilization across open connections
+func publishFlowUtilization() {
+	var connection, stream float64
+	connsMu.Lock()
+	for state := range conns {
+		if state.flow != nil {
+			c, s := state.flow.utilization()
+			connection, stream = max(connection, c), max(stream, s)
+		}
+	}
+	connsMu.Unlock()
+	connectionUtilization.Set(connection)
+	streamUtilization.Set(stream)
+}
+
+// deliveryTracker follows the ACKs for a connection's stream data, so
+// -linger can tell when the client has received everything written to a
+// stream. An ACK means the client's QUIC stack holds the data, not that the
+// application has read it, but from then on closing the connection can't
+// lose it.
+type deliveryTracker struct {
+	mu       sync.Mutex
+	inFlight map[logging.PacketNumber][]*logging.StreamFrame // unacknowledged 1-RTT packets carrying watched streams
+	streams  map[logging.StreamID]*streamDelivery
+}
+
+// streamDelivery tracks how much of one stream has been acknowledged
+type streamDelivery struct {
+	acked     logging.ByteCount      // every byte before this offset is acknowledged
+	ahead     []*logging.StreamFrame // acknowledged frames beyond a gap
+	finalSize logging.ByteCount
+	finAcked  bool
+	done      chan struct{}
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{
+		inFlight: make(map[logging.PacketNumber][]*logging.StreamFrame),
+		streams:  make(map[logging.StreamID]*streamDelivery),
+	}
+}
+
+// watch starts following a stream and returns a channel that is closed once
+// all of it, including the FIN, has been acknowledged. It must be called
+// before anything is written. A nil tracker returns a nil channel.
+func (t *deliveryTracker) watch(id quic.StreamID) <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := &streamDelivery{done: make(chan struct{})}
+	t.streams[id] = d
+	return d.done
+}
+
+// forget stops following a stream
+func (t *deliveryTracker) forget(id quic.StreamID) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.streams, id)
+}
+
+func (t *deliveryTracker) tracer() *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		SentShortHeaderPacket: func(hdr *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, frames []logging.Frame) {
+			t.sent(hdr.PacketNumber, frames)
+		},
+		AcknowledgedPacket: func(encLevel logging.EncryptionLevel, pn logging.PacketNumber) {
+			if encLevel == logging.Encryption1RTT {
+				t.acknowledged(pn)
+			}
+		},
+		// Lost data is retransmitted in new packets, which are tracked in turn
+		LostPacket: func(encLevel logging.EncryptionLevel, pn logging.PacketNumber, _ logging.PacketLossReason) {
+			if encLevel == logging.Encryption1RTT {
+				t.mu.Lock()
+				delete(t.inFlight, pn)
+				t.mu.Unlock()
+			}
+		},
+	}
+}
+
+func (t *deliveryTracker) sent(pn logging.PacketNumber, frames []logging.Frame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var watched []*logging.StreamFrame
+	for _, frame := range frames {
+		if f, ok := frame.(*logging.StreamFrame); ok && t.streams[f.StreamID] != nil {
+			watched = append(watched, f)
+		}
+	}
+	if len(watched) > 0 {
+		t.inFlight[pn] = watched
+	}
+}
+
+func (t *deliveryTracker) acknowledged(pn logging.PacketNumber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range t.inFlight[pn] {
+		if d := t.streams[f.StreamID]; d != nil {
+			d.ack(f)
+		}
+	}
+	delete(t.inFlight, pn)
+}
+
+// ack records an acknowledged frame, advancing the acknowledged offset over
+// any frames that now follow on without a gap
+func (d *streamDelivery) ack(f *logging.StreamFrame) {
+	if f.Fin {
+		d.finalSize = f.Offset + f.Length
+		d.finAcked = true
+	}
+	d.ahead = append(d.ahead, f)
+	for advanced := true; advanced; {
+		advanced = false
+		for i := 0; i < len(d.ahead); i++ {
+			if f := d.ahead[i]; f.Offset <= d.acked {
+				d.acked = max(d.acked, f.Offset+f.Length)
+				d.ahead = append(d.ahead[:i], d.ahead[i+1:]...)
+				i--
+				advanced = true
+			}
+		}
+	}
+	if d.finAcked && d.acked >= d.finalSize {
+		select {
+		case <-d.done:
+		default:
+			close(d.done)
+		}
+	}
+}
+
+// logHandshakeAbort records why a connection died before its handshake
+// completed. Aborts quic-go raised itself, such as PROTOCOL_VIOLATION or
+// CRYPTO_BUFFER_EXCEEDED for oversized CRYPTO data, are logged; clients
+// that give up or time out are only counted.
+func logHandshakeAbort(connID logging.ConnectionID, err error) {
+	var transportErr *quic.TransportError
+	var timeoutErr *quic.HandshakeTimeoutError
+	switch {
+	case errors.As(err, &transportErr) && !transportErr.Remote:
+		name := transportErr.ErrorCode.String()
+		if transportErr.ErrorCode.IsCryptoError() {
+			name = "CRYPTO_ERROR"
+		}
+		handshakeAborts.Add(name, 1)
+		fmt.Printf("⛔ [%s] Aborted handshake: %v\n", connID, err)
+	case errors.As(err, &timeoutErr):
+		handshakeAborts.Add("handshake_timeout", 1)
+		debugf("⛔ [%s] Handshake timed out\n", connID)
+	default:
+		handshakeAborts.Add("other", 1)
+		debugf("⛔ [%s] Handshake ended early: %v\n", connID, err)
+	}
+}
+
+// wireStats compares the bytes a connection put on the wire with the
+// application payload it carried, to show QUIC's framing, encryption and
+// handshake overhead for a given workload
+type wireStats struct {
+	wireSent, wireReceived       atomic.Int64
+	packetsSent                  atomic.Int64
+	payloadSent, payloadReceived atomic.Int64
+}
+
+// report prints the totals and the wire-to-payload ratio to out
+func (w *wireStats) report(out io.Writer, remote net.Addr) {
+	wire := w.wireSent.Load() + w.wireReceived.Load()
+	payload := w.payloadSent.Load() + w.payloadReceived.Load()
+	fmt.Fprintf(out, "📦 Connection from %s: %d bytes on the wire (%d sent in %d packets, %d received) for %d payload bytes (%d sent, %d received)",
+		remote, wire, w.wireSent.Load(), w.packetsSent.Load(), w.wireReceived.Load(), payload, w.payloadSent.Load(), w.payloadReceived.Load())
+	if payload > 0 {
+		fmt.Fprintf(out, ", %.2fx overhead", float64(wire)/float64(payload))
+	}
+	fmt.Fprintln(out)
+}
+
+// parseVersions turns a list like "v1,v2" into QUIC versions
+func parseVersions(list string) ([]quic.Version, error) {
+	var versions []quic.Version
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "v1":
+			versions = append(versions, quic.Version1)
+		case "v2":
+			versions = append(versions, quic.Version2)
+		default:
+			return nil, fmt.Errorf("unknown QUIC version %q", name)
+		}
+	}
+	return versions, nil
+}
+
+// versionAge orders the QUIC versions parseVersions knows from oldest to
+// newest; their numbers on the wire are no use for that
+func versionAge(version quic.Version) int {
+	return slices.Index([]quic.Version{quic.Version1, quic.Version2}, version)
+}
+
+// jitter picks random delays uniformly from [min, max]. It uses its own
+// seeded RNG so a chaos run can be reproduced with the same -seed.
+type jitter struct {
+	min, max time.Duration
+
+	mu  sync.Mutex
+	rng *mathrand.Rand
+}
+
+// parseJitter accepts either a maximum ("100ms") or a range ("50ms-200ms")
+func parseJitter(spec string, seed int64) (*jitter, error) {
+	lo, hi, isRange := strings.Cut(spec, "-")
+	if !isRange {
+		lo, hi = "0s", spec
+	}
+	minDelay, err := time.ParseDuration(lo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jitter %q: %w", spec, err)
+	}
+	maxDelay, err := time.ParseDuration(hi)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jitter %q: %w", spec, err)
+	}
+	if minDelay < 0 || maxDelay < minDelay {
+		return nil, fmt.Errorf("invalid jitter %q: range must be non-negative and ascending", spec)
+	}
+	return &jitter{min: minDelay, max: maxDelay, rng: mathrand.New(mathrand.NewSource(seed))}, nil
+}
+
+func (j *jitter) next() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.min + time.Duration(j.rng.Int63n(int64(j.max-j.min)+1))
+}
+
+// Sleep waits for the next random delay. It returns early with the
+// context's error if ctx is done first, e.g. because the stream was reset.
+func (j *jitter) Sleep(ctx context.Context) (time.Duration, error) {
+	delay := j.next()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return delay, context.Cause(ctx)
+	}
+}
+
+// serverALPN lists the application protocols the server speaks in order of
+// preference, which crypto/tls follows: with -compress, a client offering
+// compression gets it
+func serverALPN() []string {
+	if *compress {
+		return []string{alpnCompressed, alpnProtocol}
+	}
+	return []string{alpnProtocol}
+}
+
+// getConfigForClient runs when a ClientHello arrives. Clients that offer
+// none of our ALPN protocols are logged and let through to crypto/tls, which
+// rejects them with a no_application_protocol alert the client can make
+// sense of. Everyone else is subject to -max-handshakes.
+func getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if !slices.ContainsFunc(hello.SupportedProtos, func(proto string) bool { return slices.Contains(serverALPN(), proto) }) {
+		fmt.Printf("🔤 Client %s offered ALPN protocols %q, but we only speak %q\n", hello.Conn.RemoteAddr(), hello.SupportedProtos, serverALPN())
+		return nil, nil
+	}
+	if connRate != nil {
+		if err := connRate.wait(hello); err != nil {
+			return nil, err
+		}
+	}
+	if handshakes != nil {
+		return handshakes.getConfigForClient(hello)
+	}
+	return nil, nil
+}
+
+// connRateLimiter paces new connections to a steady rate, letting up to
+// burst through back to back, so a storm of clients turns into a queue of
+// handshakes instead of all of them competing for the CPU at once. It is
+// the generic cell rate algorithm: tat, the theoretical arrival time, is
+// when the next connection would be due if they all came at the steady rate.
+type connRateLimiter struct {
+	interval time.Duration // between connections at the steady rate
+	burst    int
+	maxWait  time.Duration
+
+	mu  sync.Mutex
+	tat time.Time
+}
+
+func newConnRateLimiter(perSecond float64, burst int, maxWait time.Duration) *connRateLimiter {
+	return &connRateLimiter{interval: time.Duration(float64(time.Second) / perSecond), burst: burst, maxWait: maxWait}
+}
+
+// wait holds a handshake back until its turn comes. One whose turn is more
+// than maxWait away is rejected at once rather than queued.
+func (l *connRateLimiter) wait(hello *tls.ClientHelloInfo) error {
+	now := time.Now()
+	l.mu.Lock()
+	tat := l.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	tat = tat.Add(l.interval)
+	allowAt := tat.Add(-time.Duration(l.burst) * l.interval)
+	delay := allowAt.Sub(now)
+	if delay > l.maxWait {
+		l.mu.Unlock()
+		fmt.Printf("🚦 Rejecting handshake from %s: over %g new connections per second\n", hello.Conn.RemoteAddr(), float64(time.Second)/float64(l.interval))
+		return errConnRateExceeded
+	}
+	l.tat = tat
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	debugf("🚦 Delaying handshake from %s by %v\n", hello.Conn.RemoteAddr(), delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-hello.Context().Done():
+		return context.Cause(hello.Context())
+	}
+}
+
+// handshakeLimiter bounds how many TLS handshakes run at once, since their
+// public-key operations are the most CPU-hungry work the server does.
+//
+// Slots are taken in GetConfigForClient rather than ConnContext: ConnContext
+// runs on the listener's packet loop, where waiting would stall every other
+// connection, while GetConfigForClient runs on the handshake's own goroutine.
+type handshakeLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func newHandshakeLimiter(limit int, wait time.Duration) *handshakeLimiter {
+	l := &handshakeLimiter{slots: make(chan struct{}, limit), wait: wait}
+	expvar.Publish("handshakes_in_progress", expvar.Func(func() any { return len(l.slots) }))
+	return l
+}
+
+// getConfigForClient waits up to l.wait for a free slot. Returning an error
+// aborts the handshake, which the client sees as a TLS alert.
+func (l *handshakeLimiter) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	slot, ok := hello.Context().Value(handshakeSlotKey{}).(*handshakeSlot)
+	if !ok {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+	case <-timer.C:
+		fmt.Printf("🚦 Rejecting handshake from %s: %d already in progress\n", hello.Conn.RemoteAddr(), cap(l.slots))
+		return nil, errTooManyHandshakes
+	case <-hello.Context().Done():
+		return nil, context.Cause(hello.Context())
+	}
+	slot.held.Store(true)
+	// The connection may have died while we waited, after AfterFunc ran
+	if hello.Context().Err() != nil {
+		slot.Release()
+	}
+	return nil, nil
+}
+
+// handshakeSlot tracks whether a connection holds a handshake slot, so the
+// slot is returned exactly once however the handshake ends
+type handshakeSlot struct {
+	limiter *handshakeLimiter
+	held    atomic.Bool
+}
+
+func (s *handshakeSlot) Release() {
+	if s.held.CompareAndSwap(true, false) {
+		<-s.limiter.slots
+	}
+}
+
+// responseCache memoizes responses by the SHA-256 of their request. It
+// holds at most size entries, evicting the least recently used one, and
+// treats entries older than ttl as missing.
+type responseCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cacheEntry struct {
+	key      [sha256.Size]byte
+	response []byte
+	stored   time.Time
+}
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// Get returns the cached response for key if there is a fresh one
+func (c *responseCache) Get(key [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Since(entry.stored) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.response, true
+}
+
+// Put stores a response, evicting the least recently used entry if full
+func (c *responseCache) Put(key [sha256.Size]byte, response []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, response: response, stored: time.Now()})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// histogram counts observations into fixed buckets, Prometheus style:
+// each bucket holds the number of observations less than or equal to its
+// upper bound. It implements expvar.Var so it can be published directly.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // one per bound, plus a final +Inf bucket
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe records a single value
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(h.bounds)]++
+	h.sum += v
+	h.count++
+}
+
+// String returns the histogram as JSON, as required by expvar.Var
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[string]uint64, len(h.counts))
+	for i, bound := range h.bounds {
+		buckets[fmt.Sprint(bound)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.counts[len(h.bounds)]
+	data, _ := json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Sum     float64           `json:"sum"`
+		Count   uint64            `json:"count"`
+	}{buckets, h.sum, h.count})
+	return string(data)
+}
+
+// connState wraps a QUIC connection with a key-value session store that
+// lives as long as the connection, so handlers can keep state across streams.
+type connState struct {
+	*quic.Conn
+
+	mu      sync.Mutex
+	session map[string]any
+
+	wire     *wireStats       // nil unless -overhead is set
+	delivery *deliveryTracker // nil unless -linger is set
+	flow     *flowStats       // nil unless -metrics-addr is set
+	idle     *appIdleTimer    // nil unless -app-idle-timeout is set
+
+	compressed bool          // whether the client negotiated alpnCompressed
+	priority   priorityClass // from the client certificate, for -max-conns
+	opened     time.Time
+
+	streamActive atomic.Bool  // whether a stream is being answered, for -single-stream
+	streams      atomic.Int32 // streams being answered, for the SIGQUIT diagnostics
+	errorsLogged atomic.Int32 // errors seen so far, for -conn-log-limit
+	logLimit     int          // -conn-log-limit when the connection opened
+}
+
+func newConnState(conn *quic.Conn) *connState {
+	wire, _ := conn.Context().Value(wireStatsKey{}).(*wireStats)
+	delivery, _ := conn.Context().Value(deliveryKey{}).(*deliveryTracker)
+	flow, _ := conn.Context().Value(flowStatsKey{}).(*flowStats)
+	state := &connState{Conn: conn, session: make(map[string]any), wire: wire, delivery: delivery, flow: flow}
+	state.compressed = conn.ConnectionState().TLS.NegotiatedProtocol == alpnCompressed
+	state.priority = connPriority(conn.ConnectionState().TLS.PeerCertificates)
+	state.opened = time.Now()
+	state.logLimit = *connLogLimit
+	if *appIdleTimeout > 0 {
+		state.idle = newAppIdleTimer(conn, *appIdleTimeout)
+	}
+	return state
+}
+
+// appIdleTimer closes a connection once none of its streams has been open
+// for the timeout. QUIC's own idle timeout is reset by every packet, keep-
+// alive PINGs included, so it never notices a client that stays connected
+// without asking for anything; this one only counts requests.
+type appIdleTimer struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	active  int
+	timer   *time.Timer
+	stopped bool // the connection is gone, handlers still finishing mustn't restart the clock
+}
+
+func newAppIdleTimer(conn *quic.Conn, timeout time.Duration) *appIdleTimer {
+	t := &appIdleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		fmt.Printf("💤 No streams from %s for %v, closing the connection\n", conn.RemoteAddr(), timeout)
+		conn.CloseWithError(0, closeReasonIdle)
+	})
+	return t
+}
+
+// streamStarted stops the clock while a stream is being answered
+func (t *appIdleTimer) streamStarted() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active++
+	t.timer.Stop()
+}
+
+// streamEnded restarts the clock once the last open stream is done
+func (t *appIdleTimer) streamEnded() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	if t.active == 0 && !t.stopped {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *appIdleTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	t.timer.Stop()
+}
+
+// requestBody returns the request as the client wrote it, inflating it if
+// the connection negotiated compression. -max-buffer limits the inflated
+// size, so a small but highly compressible request can't exhaust memory.
+func (c *connState) requestBody(input io.Reader) io.Reader {
+	if c.compressed {
+		return flate.NewReader(input)
+	}
+	return input
+}
+
+// logError prints an error caused by this connection's client, unless it
+// has already caused -conn-log-limit of them. From then on they are only
+// counted, so one misbehaving client can't flood the log.
+func (c *connState) logError(format string, args ...any) {
+	n := int(c.errorsLogged.Add(1))
+	if c.logLimit <= 0 || n <= c.logLimit {
+		fmt.Printf(format, args...)
+	}
+	if n == c.logLimit {
+		fmt.Printf("🤐 Logged %d errors from %s, counting the rest quietly\n", n, c.RemoteAddr())
+	}
+}
+
+// reportSuppressedErrors says how many errors logError held back
+func (c *connState) reportSuppressedErrors() {
+	if suppressed := int(c.errorsLogged.Load()) - c.logLimit; c.logLimit > 0 && suppressed > 0 {
+		fmt.Printf("🤐 Suppressed %d more errors from %s\n", suppressed, c.RemoteAddr())
+	}
+}
+
+// countPayload records application bytes read from and written to the
+// connection's streams for -overhead
+func (c *connState) countPayload(received, sent int) {
+	if c.wire == nil {
+		return
+	}
+	c.wire.payloadReceived.Add(int64(received))
+	c.wire.payloadSent.Add(int64(sent))
+}
+
+// SetSession stores a value under key for the rest of the connection.
+func (c *connState) SetSession(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		return // the connection is gone; a late stream has nobody to remember for
+	}
+	c.session[key] = value
+}
+
+// GetSession returns the value stored under key, if any.
+func (c *connState) GetSession(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.session[key]
+	return value, ok
+}
+
+// UpdateSession replaces the value stored under key with what update
+// returns for the current one, and returns the new value. Concurrent
+// streams can't interleave between the read and the write, as they could
+// between a GetSession and a SetSession.
+func (c *connState) UpdateSession(key string, update func(old any, ok bool) any) any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.session[key]
+	value := update(old, ok)
+	if c.session != nil {
+		c.session[key] = value
+	}
+	return value
+}
+
+// clearSession drops the session store once the connection is done with.
+// Stream handlers can outlive handleConnection by a little, and a client
+// that reconnects gets a new connState anyway, but this makes sure nothing
+// stored here is kept alive, or read, after the disconnect.
+func (c *connState) clearSession() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	debugf("🧹 Dropping %d session entries for %s\n", len(c.session), c.RemoteAddr())
+	c.session = nil
+}
+
+// progressReader reads from a stream with a read deadline that is pushed
+// back before every read, so it only fires when the client stops sending
+// rather than when a large transfer simply takes a while. It never extends
+// past line, the deadline for the line being read, or limit, the overall
+// -handler-timeout deadline, whichever of them are set. A zero timeout
+// leaves only those two.
+type progressReader struct {
+	stream  *quic.Stream
+	timeout time.Duration
+	line    time.Time
+	limit   time.Time
+}
+
+// Read returns errStalled if no data arrives within the timeout and
+// errLineTimeout if the line deadline passes first
+func (r *progressReader) Read(p []byte) (int, error) {
+	var deadline time.Time
+	var cause error
+	if r.timeout > 0 {
+		deadline, cause = time.Now().Add(r.timeout), errStalled
+	}
+	if !r.line.IsZero() && (deadline.IsZero() || r.line.Before(deadline)) {
+		deadline, cause = r.line, errLineTimeout
+	}
+	if !r.limit.IsZero() && (deadline.IsZero() || r.limit.Before(deadline)) {
+		deadline, cause = r.limit, nil
+	}
+	r.stream.SetReadDeadline(deadline)
+	n, err := r.stream.Read(p)
+	if cause != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, cause
+	}
+	return n, err
+}
+
+// streamBuffer accumulates the data read from a stream up to a hard cap,
+// so a client that keeps sending without closing can't exhaust memory.
+type streamBuffer struct {
+	data  []byte
+	limit int
+}
+
+func newStreamBuffer(limit int) *streamBuffer {
+	return &streamBuffer{limit: limit}
+}
+
+// Fill reads from r until EOF. It returns errPayloadTooLarge as soon as
+// more than limit bytes have been received.
+func (b *streamBuffer) Fill(r io.Reader) error {
+	chunk := make([]byte, 1024)
+	for {
+		n, err := r.Read(chunk)
+		if len(b.data)+n > b.limit {
+			return errPayloadTooLarge
+		}
+		b.data = append(b.data, chunk[:n]...)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Len returns the number of bytes buffered so far.
+func (b *streamBuffer) Len() int { return len(b.data) }
+
+// Limit returns the maximum number of bytes the buffer will hold.
+func (b *streamBuffer) Limit() int { return b.limit }
+
+// Bytes returns the buffered data.
+func (b *streamBuffer) Bytes() []byte { return b.data }
+
+// requireClientCerts makes the server ask for, and verify, a client
+// certificate issued by one of the CAs in caFile
+func requireClientCerts(tlsConf *tls.Config, caFile string) error {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+	tlsConf.ClientCAs = pool
+	tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// Generate a self-signed certificate for testing, with a -key-type key
+func generateTLSConfig() *tls.Config {
+	certPEM, keyPEM, err := generateCertificate([]string{"localhost", "127.0.0.1"}, 365*24*time.Hour, *keyType)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   serverALPN(),
+	}
+}
+
+// loadTLSConfig serves the certificate and key in a certfile,keyfile pair
+func loadTLSConfig(pair string) (*tls.Config, error) {
+	certFile, keyFile, ok := strings.Cut(pair, ",")
+	if !ok {
+		return nil, fmt.Errorf("want certfile,keyfile, got %q", pair)
+	}
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   serverALPN(),
+	}, nil
+}
+
+// generateCertificate creates a self-signed certificate valid for the given
+// host names and IP addresses, with an "rsa" (2048 bit) or "ecdsa" (P-256)
+// key, and returns it and its key PEM encoded
+func generateCertificate(hosts []string, validFor time.Duration, keyType string) (certPEM, keyPEM []byte, err error) {
+	var key crypto.Signer
+	keyUsage := x509.KeyUsageDigitalSignature
+	switch keyType {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		// RSA key exchange encrypts the session key with the certificate's key
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("unknown key type %q, want rsa or ecdsa", keyType)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Certificates that outlive a single run need serial numbers that differ
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"QUIC Learning Lab"},
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validFor),
+		KeyUsage:    keyUsage,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// gencert implements the gencert subcommand: it writes a self-signed
+// certificate and its key to files, for -cert to serve on later runs
+func gencert(args []string) error {
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "comma-separated host names and IP addresses the certificate is valid for")
+	validFor := fs.Duration("valid-for", 365*24*time.Hour, "how long the certificate stays valid")
+	keyType := fs.String("key-type", "rsa", "key type: rsa (2048 bit) or ecdsa (P-256)")
+	certOut := fs.String("cert-out", "cert.pem", "file to write the certificate to")
+	keyOut := fs.String("key-out", "key.pem", "file to write the private key to")
+	fs.Parse(args)
+
+	certPEM, keyPEM, err := generateCertificate(strings.Split(*hosts, ","), *validFor, *keyType)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*certOut, certPEM, 0o644); err != nil {
+		return err
+	}
+	// Only the owner should be able to read the private key
+	if err := os.WriteFile(*keyOut, keyPEM, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("📜 Wrote an %s certificate for %s to %s and its key to %s, valid until %s\n",
+		strings.ToUpper(*keyType), *hosts, *certOut, *keyOut, time.Now().Add(*validFor).Format(time.DateOnly))
+	fmt.Printf("   Serve it with: go run server.go -cert %s,%s\n", *certOut, *keyOut)
+	return nil
+}
@@ -0,0 +1,2288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Both programs are package main in one directory, so name the files:
+//
+//	go test server.go server_test.go
+
+// setFlag sets a command-line flag for the rest of the test
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+// listenServer listens on a random local port through the server's
+// transport, with the QUIC configuration main builds from the flags as the
+// test set them. A nil tlsConf gets a generated certificate, as in main.
+func listenServer(t *testing.T, tlsConf *tls.Config) *quic.Listener {
+	t.Helper()
+	udpConn, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listenServerOn(t, udpConn, tlsConf)
+}
+
+// listenServerOn is listenServer on a socket the test already bound
+func listenServerOn(t *testing.T, udpConn *net.UDPConn, tlsConf *tls.Config) *quic.Listener {
+	t.Helper()
+	versions, err := parseVersions(*quicVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConf == nil {
+		tlsConf = generateTLSConfig()
+	}
+	if tlsConf.GetConfigForClient == nil {
+		tlsConf.GetConfigForClient = getConfigForClient
+	}
+	transport := newTransport(udpConn)
+	listener, err := transport.Listen(tlsConf, &quic.Config{
+		Versions:                versions,
+		InitialPacketSize:       uint16(*packetSize),
+		DisablePathMTUDiscovery: *disablePMTUD,
+		EnableDatagrams:         *datagramAck,
+		Tracer:                  newConnectionTracer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		transport.Close()
+		udpConn.Close()
+		// The next test shouldn't find these in conns
+		waitForDisconnects(time.Second)
+	})
+	return listener
+}
+
+// startServer serves every connection listenServer accepts through main's
+// accept loop, and returns the address to dial
+func startServer(t *testing.T, tlsConf *tls.Config, minVersion quic.Version) string {
+	t.Helper()
+	listener := listenServer(t, tlsConf)
+	go acceptConnections(listener, minVersion)
+	return listener.Addr().String()
+}
+
+// dialServer connects to addr like the example client. A nil tlsConf or
+// quicConf gets the client's defaults.
+func dialServer(t *testing.T, addr string, tlsConf *tls.Config, quicConf *quic.Config) *quic.Conn {
+	t.Helper()
+	if tlsConf == nil {
+		tlsConf = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnProtocol}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, quicConf)
+	if err != nil {
+		t.Fatalf("dialing the server: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "test done") })
+	return conn
+}
+
+// testContext returns a context that bounds a test's round trips
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// onlyConn returns the connState of the one connection the server has open
+func onlyConn(t *testing.T) *connState {
+	t.Helper()
+	var state *connState
+	found := waitFor(time.Second, func() bool {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+		for state = range conns {
+		}
+		return len(conns) == 1
+	})
+	if !found {
+		t.Fatal("the server doesn't have exactly one connection open")
+	}
+	return state
+}
+
+// startRelay forwards UDP between one client and the server at addr, like
+// a path between them that loses the packets drop picks. It returns the
+// address for the client to dial instead of the server's.
+func startRelay(t *testing.T, addr string, drop func(toClient bool, packet []byte) bool) string {
+	t.Helper()
+	front, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		packet := make([]byte, 65536)
+		for {
+			n, from, err := front.ReadFromUDP(packet)
+			if err != nil {
+				return
+			}
+			client.Store(from)
+			if !drop(false, packet[:n]) {
+				back.Write(packet[:n])
+			}
+		}
+	}()
+	go func() {
+		packet := make([]byte, 65536)
+		for {
+			n, err := back.Read(packet)
+			if err != nil {
+				return
+			}
+			if to := client.Load(); to != nil && !drop(true, packet[:n]) {
+				front.WriteToUDP(packet[:n], to)
+			}
+		}
+	}()
+	return front.LocalAddr().String()
+}
+
+// waitFor polls cond until it holds or timeout passes, and returns its last result
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// wantStreamReset fails the test unless err is a reset with code
+func wantStreamReset(t *testing.T, err error, code quic.StreamErrorCode) {
+	t.Helper()
+	var streamErr *quic.StreamError
+	if !errors.As(err, &streamErr) || streamErr.ErrorCode != code {
+		t.Fatalf("got %v, want a reset with code %#x", err, code)
+	}
+}
+
+func TestStreamBufferCap(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		limit   int
+		wantErr error
+	}{
+		{"empty", "", 4, nil},
+		{"under the limit", "abc", 4, nil},
+		{"exactly the limit", "abcd", 4, nil},
+		{"one byte over", "abcde", 4, errPayloadTooLarge},
+		{"limit spanning reads", strings.Repeat("x", 3000), 3000, nil},
+		{"over a limit spanning reads", strings.Repeat("x", 3001), 3000, errPayloadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := newStreamBuffer(tt.limit)
+			err := buffer.Fill(strings.NewReader(tt.input))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Fill() = %v, want %v", err, tt.wantErr)
+			}
+			if buffer.Len() > buffer.Limit() {
+				t.Errorf("buffered %d bytes, over the limit of %d", buffer.Len(), buffer.Limit())
+			}
+			if tt.wantErr == nil && !bytes.Equal(buffer.Bytes(), []byte(tt.input)) {
+				t.Errorf("buffered %d bytes, want the %d sent", buffer.Len(), len(tt.input))
+			}
+		})
+	}
+}
+
+// A fresh buffer per stream means one stream's data never counts
+// against the next one's limit
+func TestStreamBufferPerStream(t *testing.T) {
+	first := newStreamBuffer(4)
+	if err := first.Fill(strings.NewReader("abcd")); err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+	second := newStreamBuffer(4)
+	if err := second.Fill(strings.NewReader("efgh")); err != nil {
+		t.Fatalf("second stream: %v", err)
+	}
+	if got := string(second.Bytes()); got != "efgh" {
+		t.Errorf("second stream buffered %q, want %q", got, "efgh")
+	}
+}
+
+func TestParseJitter(t *testing.T) {
+	tests := []struct {
+		spec     string
+		min, max time.Duration
+		wantErr  bool
+	}{
+		{spec: "100ms", min: 0, max: 100 * time.Millisecond},
+		{spec: "50ms-200ms", min: 50 * time.Millisecond, max: 200 * time.Millisecond},
+		{spec: "0s", min: 0, max: 0},
+		{spec: "20ms-20ms", min: 20 * time.Millisecond, max: 20 * time.Millisecond},
+		{spec: "200ms-50ms", wantErr: true},
+		{spec: "-5ms", wantErr: true},
+		{spec: "soon", wantErr: true},
+		{spec: "10ms-later", wantErr: true},
+	}
+	for _, tt := range tests {
+		j, err := parseJitter(tt.spec, 1)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseJitter(%q) succeeded, want an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseJitter(%q): %v", tt.spec, err)
+			continue
+		}
+		if j.min != tt.min || j.max != tt.max {
+			t.Errorf("parseJitter(%q) = %v-%v, want %v-%v", tt.spec, j.min, j.max, tt.min, tt.max)
+		}
+	}
+}
+
+func TestJitterStaysInRange(t *testing.T) {
+	j, err := parseJitter("10ms-20ms", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 1000 {
+		if delay := j.next(); delay < j.min || delay > j.max {
+			t.Fatalf("delay %v outside %v-%v", delay, j.min, j.max)
+		}
+	}
+}
+
+// The same seed must replay the same delays, so a run can be reproduced
+func TestJitterSeedRepeats(t *testing.T) {
+	a, _ := parseJitter("0s-1s", 7)
+	b, _ := parseJitter("0s-1s", 7)
+	for i := range 100 {
+		if da, db := a.next(), b.next(); da != db {
+			t.Fatalf("delay %d: %v and %v from the same seed", i, da, db)
+		}
+	}
+}
+
+func cacheKey(request string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(request))
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newResponseCache(2, time.Minute)
+	cache.Put(cacheKey("a"), []byte("A"))
+	cache.Put(cacheKey("b"), []byte("B"))
+
+	// Using a makes b the least recently used
+	if _, ok := cache.Get(cacheKey("a")); !ok {
+		t.Fatal("a missing before the cache was full")
+	}
+	cache.Put(cacheKey("c"), []byte("C"))
+
+	if _, ok := cache.Get(cacheKey("b")); ok {
+		t.Error("b still cached, want it evicted as least recently used")
+	}
+	for _, request := range []string{"a", "c"} {
+		if response, ok := cache.Get(cacheKey(request)); !ok || string(response) != strings.ToUpper(request) {
+			t.Errorf("Get(%q) = %q, %v, want %q", request, response, ok, strings.ToUpper(request))
+		}
+	}
+}
+
+func TestResponseCachePutReplaces(t *testing.T) {
+	cache := newResponseCache(2, time.Minute)
+	cache.Put(cacheKey("a"), []byte("old"))
+	cache.Put(cacheKey("a"), []byte("new"))
+	cache.Put(cacheKey("b"), []byte("B"))
+
+	// Replacing a must not have taken a second slot
+	if response, ok := cache.Get(cacheKey("a")); !ok || string(response) != "new" {
+		t.Errorf("Get(a) = %q, %v, want %q", response, ok, "new")
+	}
+	if _, ok := cache.Get(cacheKey("b")); !ok {
+		t.Error("b evicted, but only two keys were stored")
+	}
+}
+
+func TestResponseCacheExpires(t *testing.T) {
+	cache := newResponseCache(2, time.Minute)
+	cache.Put(cacheKey("a"), []byte("A"))
+	cache.entries[cacheKey("a")].Value.(*cacheEntry).stored = time.Now().Add(-2 * time.Minute)
+
+	if _, ok := cache.Get(cacheKey("a")); ok {
+		t.Error("entry older than the TTL was served")
+	}
+	if len(cache.entries) != 0 || cache.order.Len() != 0 {
+		t.Errorf("expired entry still held: %d entries, %d in order", len(cache.entries), cache.order.Len())
+	}
+}
+
+func TestParseTransformsComposesInOrder(t *testing.T) {
+	tests := []struct {
+		spec, input, want string
+	}{
+		{"upper", "héllo", "HÉLLO"},
+		{"upper,reverse", "héllo world", "DLROW OLLÉH"},
+		{"reverse, lower", "ABC", "cba"},
+		{"upper,lower", "MiXeD", "mixed"},
+		{"lower,upper", "MiXeD", "MIXED"},
+		{"reverse,reverse", "héllo", "héllo"},
+	}
+	for _, tt := range tests {
+		pipeline, err := parseTransforms(tt.spec)
+		if err != nil {
+			t.Errorf("parseTransforms(%q): %v", tt.spec, err)
+			continue
+		}
+		input := []byte(tt.input)
+		got, err := pipeline(input)
+		if err != nil {
+			t.Errorf("%q on %q: %v", tt.spec, tt.input, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%q on %q = %q, want %q", tt.spec, tt.input, got, tt.want)
+		}
+		if string(input) != tt.input {
+			t.Errorf("%q modified its input to %q", tt.spec, input)
+		}
+	}
+}
+
+func TestParseTransformsCompressBase64(t *testing.T) {
+	pipeline, err := parseTransforms("compress,base64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Repeat("hello ", 100)
+	got, err := pipeline([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(string(got))
+	if err != nil {
+		t.Fatalf("output isn't base64: %v", err)
+	}
+	inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatalf("decoded output isn't deflate data: %v", err)
+	}
+	if string(inflated) != input {
+		t.Errorf("round trip gave %d bytes, want the %d sent", len(inflated), len(input))
+	}
+}
+
+func TestParseTransformsRejectsUnknown(t *testing.T) {
+	for _, spec := range []string{"upper,shout", "", "upper,", "Upper"} {
+		if _, err := parseTransforms(spec); err == nil {
+			t.Errorf("parseTransforms(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestInputCountsMatchesWC(t *testing.T) {
+	tests := []struct {
+		input               string
+		bytes, lines, words int64
+	}{
+		{"", 0, 0, 0},
+		{"one", 3, 0, 1},
+		{"one two\n", 8, 1, 2},
+		{"  leading and trailing  \n\n", 26, 2, 3},
+		{"tabs\tand\nnewlines\r\nmix", 22, 2, 4},
+	}
+	for _, tt := range tests {
+		var counts inputCounts
+		counts.Write([]byte(tt.input))
+		if counts.bytes != tt.bytes || counts.lines != tt.lines || counts.words != tt.words {
+			t.Errorf("%q counted %d bytes, %d lines, %d words, want %d, %d, %d",
+				tt.input, counts.bytes, counts.lines, counts.words, tt.bytes, tt.lines, tt.words)
+		}
+	}
+}
+
+// Input arrives in arbitrary chunks, and a word split across two of them
+// must count once
+func TestInputCountsAcrossChunks(t *testing.T) {
+	input := "the quick brown fox\njumps over\nthe lazy dog"
+	var whole inputCounts
+	whole.Write([]byte(input))
+	for size := 1; size <= len(input); size++ {
+		var chunked inputCounts
+		for chunk := range slices.Chunk([]byte(input), size) {
+			chunked.Write(chunk)
+		}
+		if chunked.bytes != whole.bytes || chunked.lines != whole.lines || chunked.words != whole.words {
+			t.Errorf("in %d-byte chunks: %d bytes, %d lines, %d words, want %d, %d, %d",
+				size, chunked.bytes, chunked.lines, chunked.words, whole.bytes, whole.lines, whole.words)
+		}
+	}
+	if whole.words != 9 {
+		t.Errorf("counted %d words, want 9", whole.words)
+	}
+}
+
+// BenchmarkHandshake compares full handshakes with an RSA and an ECDSA
+// certificate, like the handshake-bench subcommand:
+//
+//	go test -run '^$' -bench Handshake server.go server_test.go
+//
+// ns/op includes generating the certificate and starting the server;
+// handshakes/s counts the handshakes alone.
+func BenchmarkHandshake(b *testing.B) {
+	versions, err := parseVersions(*quicVersions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, keyType := range []string{"rsa", "ecdsa"} {
+		b.Run(keyType, func(b *testing.B) {
+			elapsed, err := benchKeyType(keyType, b.N, 1, versions)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(b.N)/elapsed.Seconds(), "handshakes/s")
+		})
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	// A 16-byte bufio buffer makes long lines span several ReadSlice calls
+	reader := bufio.NewReaderSize(strings.NewReader("short\n"+strings.Repeat("x", 40)+"\nlast"), 16)
+	for _, want := range []string{"short\n", strings.Repeat("x", 40) + "\n"} {
+		line, err := readLine(reader, 64)
+		if err != nil || string(line) != want {
+			t.Fatalf("readLine() = %q, %v, want %q", line, err, want)
+		}
+	}
+	// The final line has no newline, so it comes with io.EOF
+	line, err := readLine(reader, 64)
+	if err != io.EOF || string(line) != "last" {
+		t.Fatalf("readLine() = %q, %v, want %q, EOF", line, err, "last")
+	}
+}
+
+func TestReadLineLimit(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader(strings.Repeat("x", 40)+"\n"), 16)
+	if line, err := readLine(reader, 40); !errors.Is(err, errPayloadTooLarge) {
+		t.Fatalf("41-byte line with a limit of 40: readLine() = %d bytes, %v, want %v", len(line), err, errPayloadTooLarge)
+	}
+}
+
+func TestConnRateLimiterBurst(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	hello := &tls.ClientHelloInfo{Conn: server}
+
+	// With no wait allowed, exactly the burst gets through at once
+	limiter := newConnRateLimiter(1, 3, 0)
+	for i := range 3 {
+		if err := limiter.wait(hello); err != nil {
+			t.Fatalf("connection %d of a burst of 3: %v", i+1, err)
+		}
+	}
+	if err := limiter.wait(hello); !errors.Is(err, errConnRateExceeded) {
+		t.Fatalf("connection 4 = %v, want %v", err, errConnRateExceeded)
+	}
+
+	// Once the steady rate's interval has passed, one more is due
+	limiter.tat = limiter.tat.Add(-limiter.interval)
+	if err := limiter.wait(hello); err != nil {
+		t.Fatalf("connection after an interval: %v", err)
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	quicConf := &quic.Config{Versions: []quic.Version{quic.Version1, quic.Version2}, Tracer: newConnectionTracer}
+	if !selftest(generateTLSConfig(), quicConf, quic.Version1) {
+		t.Fatal("self-test failed against a healthy build")
+	}
+	if quicConf.EnableDatagrams {
+		t.Error("selftest enabled datagrams on the caller's QUIC configuration")
+	}
+}
+
+// dialCompressed connects to a -compress server offering compression, as
+// the client's -compress does
+func dialCompressed(t *testing.T, addr string) *quic.Conn {
+	t.Helper()
+	conn := dialServer(t, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnCompressed, alpnProtocol}}, nil)
+	if proto := conn.ConnectionState().TLS.NegotiatedProtocol; proto != alpnCompressed {
+		t.Fatalf("negotiated %q, want %q", proto, alpnCompressed)
+	}
+	return conn
+}
+
+// deflateRoundTrip sends request deflated and returns the inflated response
+func deflateRoundTrip(ctx context.Context, conn *quic.Conn, request []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	zw, _ := flate.NewWriter(stream, flate.DefaultCompression)
+	if _, err := zw.Write(request); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	stream.Close()
+	return io.ReadAll(flate.NewReader(stream))
+}
+
+func TestCompressedEcho(t *testing.T) {
+	setFlag(t, "compress", "true")
+	conn := dialCompressed(t, startServer(t, nil, 0))
+	ctx := testContext(t)
+
+	for _, request := range []string{"Hello, deflate!", strings.Repeat("compressible ", 5000)} {
+		response, err := deflateRoundTrip(ctx, conn, []byte(request))
+		if err != nil {
+			t.Fatalf("compressed echo: %v", err)
+		}
+		if want := "Echo: " + request; string(response) != want {
+			t.Errorf("compressed echo gave %d bytes, want %d", len(response), len(want))
+		}
+	}
+
+	// -max-buffer limits the inflated request, not what crossed the wire
+	_, err := deflateRoundTrip(ctx, conn, bytes.Repeat([]byte("z"), *maxBuffer+1))
+	wantStreamReset(t, err, errorCodePayloadTooLarge)
+}
+
+// Every numbered line must arrive on its own, not once the compressor has
+// a block's worth, for the line-at-a-time exchange to work
+func TestCompressedNumberedLines(t *testing.T) {
+	setFlag(t, "compress", "true")
+	setFlag(t, "number-lines", "true")
+	conn := dialCompressed(t, startServer(t, nil, 0))
+
+	stream, err := conn.OpenStreamSync(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw, _ := flate.NewWriter(stream, flate.DefaultCompression)
+	reader := bufio.NewReader(flate.NewReader(stream))
+	for i, line := range []string{"first line", "second line", "third line"} {
+		if _, err := io.WriteString(zw, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading line %d: %v", i+1, err)
+		}
+		if want := fmt.Sprintf("%6d\t%s\n", i+1, line); got != want {
+			t.Errorf("line %d = %q, want %q", i+1, got, want)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if rest, err := io.ReadAll(reader); err != nil || len(rest) > 0 {
+		t.Errorf("after the last line: %q, %v, want a clean end of the stream", rest, err)
+	}
+}
+
+func TestHandshakeLimiterFlood(t *testing.T) {
+	const limit, clients = 2, 20
+	// Built by hand: newHandshakeLimiter publishes an expvar, which can
+	// only happen once per process
+	handshakes = &handshakeLimiter{slots: make(chan struct{}, limit), wait: 10 * time.Second}
+	defer func() { handshakes = nil }()
+
+	// A handshake is in flight from getting past the limiter until Accept
+	// returns its connection, which is before serveConnection frees its slot
+	var (
+		mu       sync.Mutex
+		inFlight = make(map[*handshakeSlot]bool)
+		peak     int
+	)
+	done := func(slot *handshakeSlot) {
+		mu.Lock()
+		delete(inFlight, slot)
+		mu.Unlock()
+	}
+	tlsConf := generateTLSConfig()
+	tlsConf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		conf, err := getConfigForClient(hello)
+		if slot, ok := hello.Context().Value(handshakeSlotKey{}).(*handshakeSlot); ok && err == nil {
+			mu.Lock()
+			inFlight[slot] = true
+			peak = max(peak, len(inFlight))
+			mu.Unlock()
+			context.AfterFunc(hello.Context(), func() { done(slot) })
+		}
+		return conf, err
+	}
+	listener := listenServer(t, tlsConf)
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			if slot, ok := conn.Context().Value(handshakeSlotKey{}).(*handshakeSlot); ok {
+				done(slot)
+			}
+			serveConnection(conn, 0)
+		}
+	}()
+
+	conns := make([]*quic.Conn, clients)
+	errs := make([]error, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			clientTLS := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnProtocol}}
+			conns[i], errs[i] = quic.DialAddr(ctx, listener.Addr().String(), clientTLS, nil)
+		}()
+	}
+	wg.Wait()
+	for i, conn := range conns {
+		if errs[i] != nil {
+			t.Errorf("handshake %d: %v", i+1, errs[i])
+			continue
+		}
+		conn.CloseWithError(0, "test done")
+	}
+	mu.Lock()
+	if peak > limit {
+		t.Errorf("%d handshakes in flight at once, want at most %d", peak, limit)
+	}
+	mu.Unlock()
+
+	// The client may finish its handshake just before the server does
+	if !waitFor(time.Second, func() bool { return len(handshakes.slots) == 0 }) {
+		t.Errorf("%d handshake slots still held after the flood", len(handshakes.slots))
+	}
+	conn := dialServer(t, listener.Addr().String(), nil, nil)
+	if err := checkEcho(testContext(t), conn); err != nil {
+		t.Fatalf("echo after the flood: %v", err)
+	}
+}
+
+func TestDrainFile(t *testing.T) {
+	setFlag(t, "drain-poll", "10ms")
+	defer func() {
+		drainMu.Lock()
+		draining = false
+		drainMu.Unlock()
+	}()
+	listener := listenServer(t, nil)
+	go acceptConnections(listener, 0)
+	path := filepath.Join(t.TempDir(), "drain")
+	go watchDrainFile(path, *drainPoll, listener)
+
+	conn := dialServer(t, listener.Addr().String(), nil, nil)
+	ctx := testContext(t)
+	if err := checkEcho(ctx, conn); err != nil {
+		t.Fatalf("echo before the drain: %v", err)
+	}
+	time.Sleep(5 * *drainPoll)
+	if isDraining() {
+		t.Fatal("draining before the drain file exists")
+	}
+
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second, isDraining) {
+		t.Fatalf("not draining a second after %s appeared", path)
+	}
+	// Open connections stay up, but take on no new streams
+	_, err := roundTrip(ctx, conn, []byte("after the drain"))
+	wantStreamReset(t, err, errorCodeDraining)
+	if _, err := listener.Accept(ctx); !isListenerClosed(err) {
+		t.Errorf("Accept() after the drain = %v, want the listener closed", err)
+	}
+}
+
+// A drain closes connections once their handlers are done. Without -linger
+// that can be before the response has made it to a client on a lossy path,
+// and the client never gets it; with -linger the handler waits for the
+// client to acknowledge all of it first.
+func TestLinger(t *testing.T) {
+	for _, tt := range []struct {
+		linger    string
+		delivered bool
+	}{
+		{"0s", false},
+		{"5s", true},
+	} {
+		t.Run("linger "+tt.linger, func(t *testing.T) {
+			setFlag(t, "linger", tt.linger)
+			// Long enough a handler to catch it in flight
+			responseJitter, _ = parseJitter("100ms-100ms", 1)
+			defer func() { responseJitter = nil }()
+			var lossy atomic.Bool
+			addr := startRelay(t, startServer(t, nil, 0), func(toClient bool, _ []byte) bool { return toClient && lossy.Load() })
+			conn := dialServer(t, addr, nil, nil)
+
+			stream, err := conn.OpenStreamSync(testContext(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := bytes.Repeat([]byte("l"), 20000)
+			stream.Write(request)
+			stream.Close()
+			stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+			response := make(chan error, 1)
+			go func() {
+				got, err := io.ReadAll(stream)
+				if err == nil && !bytes.Equal(got, fmt.Appendf(nil, "Echo: %s", request)) {
+					err = fmt.Errorf("got %d bytes, want the whole echo", len(got))
+				}
+				response <- err
+			}()
+
+			// The response goes missing for a while, as on a bad path
+			state := onlyConn(t)
+			if !waitFor(time.Second, func() bool { return state.streams.Load() == 1 }) {
+				t.Fatal("the request never reached a handler")
+			}
+			lossy.Store(true)
+			time.AfterFunc(300*time.Millisecond, func() { lossy.Store(false) })
+
+			// What a drain does once the handlers are done
+			inflight.Wait()
+			closeAllConnections(closeReasonDraining)
+
+			err = <-response
+			if tt.delivered && err != nil {
+				t.Errorf("with -linger %s the client lost the response: %v", tt.linger, err)
+			}
+			if !tt.delivered && err == nil {
+				t.Errorf("with -linger %s the whole response arrived, want it cut off by the close", tt.linger)
+			}
+		})
+	}
+}
+
+func TestProgressTimeout(t *testing.T) {
+	setFlag(t, "progress-timeout", "200ms")
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+
+	// Slow but steady: the whole request takes longer than the timeout,
+	// but no gap between its chunks does
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request []byte
+	for i := range 8 {
+		chunk := fmt.Appendf(nil, "chunk %d ", i)
+		stream.Write(chunk)
+		request = append(request, chunk...)
+		time.Sleep(75 * time.Millisecond)
+	}
+	stream.Close()
+	response, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("slow but steady sender: %v", err)
+	}
+	if want := fmt.Appendf(nil, "Echo: %s", request); !bytes.Equal(response, want) {
+		t.Errorf("slow but steady sender got %q, want %q", response, want)
+	}
+
+	// Stalled: one chunk, then nothing
+	stream, err = conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("and then nothing"))
+	start := time.Now()
+	_, err = io.ReadAll(stream)
+	wantStreamReset(t, err, errorCodeStalled)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("stalled sender reset after %v, before the progress timeout", elapsed)
+	}
+}
+
+// A line may be slow to start, but once started has -line-timeout to end.
+// The half line a stalled client leaves behind is dropped, not numbered.
+func TestLineTimeout(t *testing.T) {
+	setFlag(t, "number-lines", "true")
+	setFlag(t, "line-timeout", "200ms")
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+
+	stream, err := conn.OpenStreamSync(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(stream)
+	stream.Write([]byte("full line\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "     1\tfull line\n" {
+		t.Fatalf("first line = %q, %v", line, err)
+	}
+	// Waiting longer than the timeout between lines is fine
+	time.Sleep(300 * time.Millisecond)
+	stream.Write([]byte("late line\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "     2\tlate line\n" {
+		t.Fatalf("line after a pause = %q, %v", line, err)
+	}
+
+	stream.Write([]byte("half"))
+	rest, err := io.ReadAll(reader)
+	wantStreamReset(t, err, errorCodeLineTimeout)
+	if len(rest) > 0 {
+		t.Errorf("got %q for the unfinished line, want nothing", rest)
+	}
+}
+
+func TestSingleStream(t *testing.T) {
+	setFlag(t, "single-stream", "true")
+	// Keeps the first stream active while the second one arrives
+	responseJitter, _ = parseJitter("300ms-300ms", 1)
+	defer func() { responseJitter = nil }()
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+
+	first := make(chan error, 1)
+	go func() { first <- checkEcho(ctx, conn) }()
+	state := onlyConn(t)
+	if !waitFor(time.Second, state.streamActive.Load) {
+		t.Fatal("the first stream never became active")
+	}
+	_, err := roundTrip(ctx, conn, []byte("second"))
+	wantStreamReset(t, err, errorCodeSingleStream)
+	if err := <-first; err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+
+	// Once the server is done with the first stream the next one is welcome
+	waitFor(time.Second, func() bool { return !state.streamActive.Load() })
+	if err := checkEcho(ctx, conn); err != nil {
+		t.Fatalf("stream after the first finished: %v", err)
+	}
+}
+
+// flowUtilizationVar reads the gauges back the way /debug/vars shows them
+func flowUtilizationVar(t *testing.T) (connection, stream float64) {
+	t.Helper()
+	var gauges struct{ Connection, Stream float64 }
+	if err := json.Unmarshal([]byte(expvar.Get("flow_control_utilization").String()), &gauges); err != nil {
+		t.Fatal(err)
+	}
+	return gauges.Connection, gauges.Stream
+}
+
+func TestFlowControlUtilization(t *testing.T) {
+	// Only whether it is set matters; nothing is served on it here
+	setFlag(t, "metrics-addr", "localhost:0")
+	defer publishFlowUtilization()
+	// A stream window much smaller than the response, which fills it up for
+	// as long as the client doesn't read
+	conn := dialServer(t, startServer(t, nil, 0), nil, &quic.Config{
+		InitialStreamReceiveWindow: 16 * 1024,
+		MaxStreamReceiveWindow:     16 * 1024,
+	})
+	state := onlyConn(t)
+
+	publishFlowUtilization()
+	if connection, stream := flowUtilizationVar(t); connection != 0 || stream != 0 {
+		t.Errorf("idle connection: utilization %v (connection), %v (stream), want 0", connection, stream)
+	}
+
+	stream, err := conn.OpenStreamSync(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := bytes.Repeat([]byte("f"), 60*1024)
+	stream.Write(request)
+	stream.Close()
+	full := waitFor(2*time.Second, func() bool {
+		_, s := state.flow.utilization()
+		return s == 1
+	})
+	publishFlowUtilization()
+	connection, streamUse := flowUtilizationVar(t)
+	if !full || streamUse != 1 {
+		t.Errorf("client not reading a large response: stream utilization %v, want 1", streamUse)
+	}
+	if connection <= 0 {
+		t.Errorf("client not reading a large response: connection utilization %v, want some", connection)
+	}
+
+	response, err := io.ReadAll(stream)
+	if err != nil || len(response) != len("Echo: ")+len(request) {
+		t.Fatalf("reading the response: %d bytes, %v", len(response), err)
+	}
+	conn.CloseWithError(0, "test done")
+	waitForDisconnects(time.Second)
+	publishFlowUtilization()
+	if connection, stream := flowUtilizationVar(t); connection != 0 || stream != 0 {
+		t.Errorf("no connections: utilization %v (connection), %v (stream), want 0", connection, stream)
+	}
+}
+
+// wantClosedWith fails the test unless conn gets closed by the server with
+// code and reason within timeout
+func wantClosedWith(t *testing.T, conn *quic.Conn, timeout time.Duration, code quic.ApplicationErrorCode, reason string) {
+	t.Helper()
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(timeout):
+		t.Fatalf("connection still open after %v, want it closed with %q", timeout, reason)
+	}
+	var appErr *quic.ApplicationError
+	if err := context.Cause(conn.Context()); !errors.As(err, &appErr) || !appErr.Remote || appErr.ErrorCode != code || appErr.ErrorMessage != reason {
+		t.Fatalf("connection closed with %v, want code %#x and %q from the server", err, code, reason)
+	}
+}
+
+func TestAppIdleTimeout(t *testing.T) {
+	setFlag(t, "app-idle-timeout", "200ms")
+	addr := startServer(t, nil, 0)
+
+	// Without requests the timer closes the connection, QUIC keep-alives or not
+	conn := dialServer(t, addr, nil, &quic.Config{KeepAlivePeriod: 50 * time.Millisecond})
+	start := time.Now()
+	wantClosedWith(t, conn, 2*time.Second, 0, closeReasonIdle)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("closed after %v, before the idle timeout", elapsed)
+	}
+
+	// The client's -app-ping echoes a ping whenever it has been idle
+	conn = dialServer(t, addr, nil, nil)
+	ctx := testContext(t)
+	for range 6 {
+		time.Sleep(100 * time.Millisecond)
+		if err := expectEcho(ctx, conn, []byte("ping")); err != nil {
+			t.Fatalf("app ping after %v: %v", time.Since(start), err)
+		}
+	}
+	// Once the pings stop, the clock runs out again
+	wantClosedWith(t, conn, 2*time.Second, 0, closeReasonIdle)
+}
+
+func TestMinVersion(t *testing.T) {
+	addr := startServer(t, nil, quic.Version2)
+
+	old := dialServer(t, addr, nil, &quic.Config{Versions: []quic.Version{quic.Version1}})
+	wantClosedWith(t, old, 2*time.Second, errorCodeVersionTooOld, fmt.Sprintf("QUIC %v or newer required", quic.Version2))
+
+	current := dialServer(t, addr, nil, &quic.Config{Versions: []quic.Version{quic.Version2}})
+	if err := checkEcho(testContext(t), current); err != nil {
+		t.Fatalf("QUIC %v client: %v", quic.Version2, err)
+	}
+	if version := current.ConnectionState().Version; version != quic.Version2 {
+		t.Errorf("negotiated QUIC %v, want %v", version, quic.Version2)
+	}
+}
+
+func TestReconnectStartsFreshSession(t *testing.T) {
+	addr := startServer(t, nil, 0)
+	ctx := testContext(t)
+
+	first := dialServer(t, addr, nil, nil)
+	for range 2 {
+		if err := checkEcho(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := onlyConn(t)
+	if requests, _ := old.GetSession("requests"); requests != 2 {
+		t.Fatalf("first connection counted %v requests, want 2", requests)
+	}
+	first.CloseWithError(0, "reconnecting")
+	if remaining := waitForDisconnects(time.Second); remaining > 0 {
+		t.Fatalf("%d connections still open after the client left", remaining)
+	}
+	if _, ok := old.GetSession("requests"); ok {
+		t.Error("the closed connection's session outlived it")
+	}
+
+	second := dialServer(t, addr, nil, nil)
+	if err := checkEcho(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	state := onlyConn(t)
+	if state == old {
+		t.Fatal("the reconnect got the old connection's state")
+	}
+	if requests, _ := state.GetSession("requests"); requests != 1 {
+		t.Errorf("reconnected connection counted %v requests, want 1", requests)
+	}
+	// A late write to the old session must not bring it back
+	old.SetSession("requests", 99)
+	old.UpdateSession("requests", func(any, bool) any { return 100 })
+	if _, ok := old.GetSession("requests"); ok {
+		t.Error("writing to a closed connection's session stored a value")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	setFlag(t, "handler-timeout", "150ms")
+
+	// Processing that takes longer than the budget. Set before the server
+	// starts, and reset only once its handlers are done with it.
+	responseJitter, _ = parseJitter("400ms-400ms", 1)
+	defer func() { responseJitter = nil }()
+	defer inflight.Wait()
+	slow := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+	start := time.Now()
+	_, err := roundTrip(ctx, slow, []byte("too slow"))
+	wantStreamReset(t, err, errorCodeHandlerTimeout)
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("reset after %v, want it once the 150ms budget ran out", elapsed)
+	}
+}
+
+func TestHandlerTimeoutPerStream(t *testing.T) {
+	setFlag(t, "handler-timeout", "150ms")
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+
+	// The budget covers the whole handler, however steadily the client sends
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 6 {
+		if _, err := stream.Write([]byte("drip ")); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	stream.Close()
+	_, err = io.ReadAll(stream)
+	wantStreamReset(t, err, errorCodeHandlerTimeout)
+
+	// Every stream gets a budget of its own
+	if err := checkEcho(ctx, conn); err != nil {
+		t.Fatalf("fast request after a timed out one: %v", err)
+	}
+}
+
+func TestRunShutdownHooks(t *testing.T) {
+	saved := shutdownHooks
+	shutdownHooks = nil
+	defer func() { shutdownHooks = saved }()
+	release := make(chan struct{})
+	defer close(release)
+
+	var (
+		mu  sync.Mutex
+		ran []int
+	)
+	record := func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, i)
+	}
+	errFlush := errors.New("flush failed")
+	RegisterShutdownHook(func(context.Context) error {
+		record(1)
+		return nil
+	})
+	RegisterShutdownHook(func(context.Context) error {
+		record(2)
+		return errFlush
+	})
+	// Ignores its context, so it has to be left behind
+	RegisterShutdownHook(func(context.Context) error {
+		record(3)
+		<-release
+		return nil
+	})
+	RegisterShutdownHook(func(ctx context.Context) error {
+		record(4)
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) < 25*time.Millisecond {
+			return errors.New("the last hook's time was used up by the one before it")
+		}
+		return nil
+	})
+
+	start := time.Now()
+	err := runShutdownHooks(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v, want the stuck hook given up on after 50ms", elapsed)
+	}
+	mu.Lock()
+	if !slices.Equal(ran, []int{1, 2, 3, 4}) {
+		t.Errorf("hooks ran as %v, want in registration order", ran)
+	}
+	mu.Unlock()
+	if !errors.Is(err, errFlush) {
+		t.Errorf("error %v doesn't include the second hook's", err)
+	}
+	for _, want := range []string{"shutdown hook 2: flush failed", "shutdown hook 3: gave up after 50ms"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v, want it to include %q", err, want)
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "hook 4") {
+		t.Errorf("error %v, want the last hook to have had its own timeout", err)
+	}
+}
+
+func TestGencert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err := gencert([]string{"-cert-out", certFile, "-key-out", keyFile, "-key-type", "rsa", "-hosts", "localhost,127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(keyFile); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("key file mode %v, want readable only by its owner", perm)
+	}
+
+	tlsConf, err := loadTLSConfig(certFile + "," + keyFile)
+	if err != nil {
+		t.Fatalf("loading the generated pair: %v", err)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, tlsConf, 0)
+	// Verify the server against the written certificate, by its IP SAN
+	conn := dialServer(t, addr, trustingTLS(t, certPEM), nil)
+	if err := checkEcho(testContext(t), conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// trustingTLS returns a client config that verifies the server against
+// certPEM alone
+func trustingTLS(t *testing.T, certPEM []byte) *tls.Config {
+	t.Helper()
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		t.Fatal("no certificate in the PEM")
+	}
+	return &tls.Config{RootCAs: roots, NextProtos: []string{alpnProtocol}}
+}
+
+func TestECDSAHandshake(t *testing.T) {
+	setFlag(t, "key-type", "ecdsa")
+	tlsConf := generateTLSConfig()
+	if _, ok := tlsConf.Certificates[0].PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("generated a %T key, want ECDSA", tlsConf.Certificates[0].PrivateKey)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsConf.Certificates[0].Certificate[0]})
+	addr := startServer(t, tlsConf, 0)
+	conn := dialServer(t, addr, trustingTLS(t, certPEM), nil)
+	if alg := conn.ConnectionState().TLS.PeerCertificates[0].PublicKeyAlgorithm; alg != x509.ECDSA {
+		t.Errorf("server presented a %v certificate, want ECDSA", alg)
+	}
+	if err := checkEcho(testContext(t), conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOversizedStreamReset(t *testing.T) {
+	setFlag(t, "max-buffer", "1024")
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+
+	stream, err := conn.OpenStreamSync(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stream past the cap and never close, so only the cap can end it
+	go stream.Write(bytes.Repeat([]byte("q"), 4*1024))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(stream)
+	wantStreamReset(t, err, errorCodePayloadTooLarge)
+
+	// Only the stream was reset, the connection keeps serving
+	if err := checkEcho(testContext(t), conn); err != nil {
+		t.Fatalf("after the reset: %v", err)
+	}
+}
+
+func TestFallbackAddr(t *testing.T) {
+	taken, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	addr := taken.LocalAddr().String()
+
+	// Without a fallback a taken port is still an error
+	if udpConn, err := listenWithFallback(addr, ""); err == nil {
+		udpConn.Close()
+		t.Fatalf("bound %s while another socket had it", addr)
+	}
+
+	var udpConn *net.UDPConn
+	output := captureOutput(t, func() {
+		udpConn, err = listenWithFallback(addr, "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatalf("falling back: %v", err)
+	}
+	if !strings.Contains(output, "falling back to 127.0.0.1:0") {
+		t.Errorf("logged %q, want it to say why it fell back", output)
+	}
+	if udpConn.LocalAddr().String() == addr {
+		t.Fatalf("bound the taken %s instead of the fallback", addr)
+	}
+
+	// The fallback socket serves like the primary one would have
+	listener := listenServerOn(t, udpConn, nil)
+	go acceptConnections(listener, 0)
+	conn := dialServer(t, listener.Addr().String(), nil, nil)
+	if err := checkEcho(testContext(t), conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnLogLimit(t *testing.T) {
+	setFlag(t, "max-buffer", "16")
+	setFlag(t, "conn-log-limit", "3")
+	// Everything that prints runs inside the capture and is done before it ends
+	output := captureOutput(t, func() {
+		conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+		ctx := testContext(t)
+		for range 7 {
+			_, err := roundTrip(ctx, conn, bytes.Repeat([]byte("q"), 64))
+			wantStreamReset(t, err, errorCodePayloadTooLarge)
+		}
+		conn.CloseWithError(0, "")
+		if remaining := waitForDisconnects(time.Second); remaining > 0 {
+			t.Errorf("%d connections still open after the client left", remaining)
+		}
+	})
+
+	if logged := strings.Count(output, "exceeded 16 buffered bytes"); logged != 3 {
+		t.Errorf("logged %d of 7 resets, want the first 3 in:\n%s", logged, output)
+	}
+	for _, want := range []string{"Logged 3 errors from", "Suppressed 4 more errors from"} {
+		if strings.Count(output, want) != 1 {
+			t.Errorf("want %q once in:\n%s", want, output)
+		}
+	}
+}
+
+func TestRequestIDsInLogs(t *testing.T) {
+	setFlag(t, "max-buffer", "256")
+	// Everything that prints runs inside the capture and is done before it ends
+	output := captureOutput(t, func() {
+		conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+		ctx := testContext(t)
+		for range 2 {
+			if err := checkEcho(ctx, conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := roundTrip(ctx, conn, bytes.Repeat([]byte("q"), 1024))
+		wantStreamReset(t, err, errorCodePayloadTooLarge)
+		conn.CloseWithError(0, "")
+		if remaining := waitForDisconnects(time.Second); remaining > 0 {
+			t.Errorf("%d connections still open after the client left", remaining)
+		}
+	})
+
+	matches := regexp.MustCompile(`Request ([0-9a-f-]{36}) is stream (\d+) from`).FindAllStringSubmatch(output, -1)
+	if len(matches) != 3 {
+		t.Fatalf("announced %d request IDs for 3 streams in:\n%s", len(matches), output)
+	}
+	seen := make(map[string]bool)
+	for i, m := range matches {
+		id := m[1]
+		if seen[id] {
+			t.Errorf("request ID %s given to two streams", id)
+		}
+		seen[id] = true
+		// Each stream's log lines carry its own ID
+		var want []string
+		if i < 2 {
+			want = []string{"Received [" + id + "]: ", "Sent [" + id + "]: "}
+		} else {
+			want = []string{"Stream " + m[2] + " [" + id + "] exceeded 256 buffered bytes"}
+		}
+		for _, line := range want {
+			if !strings.Contains(output, line) {
+				t.Errorf("want %q in:\n%s", line, output)
+			}
+		}
+	}
+}
+
+func TestSessionSharedAcrossStreams(t *testing.T) {
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+
+	// Each stream's handler counts itself on top of what the last one stored
+	for want := 1; want <= 2; want++ {
+		if err := checkEcho(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+		if requests, _ := onlyConn(t).GetSession("requests"); requests != want {
+			t.Fatalf("after stream %d the session counted %v requests, want %d", want, requests, want)
+		}
+	}
+
+	// Two streams in flight at once still both count
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- checkEcho(ctx, conn)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests, _ := onlyConn(t).GetSession("requests"); requests != 4 {
+		t.Errorf("after two concurrent streams the session counted %v requests, want 4", requests)
+	}
+}
+
+func TestUpdateSessionCountsConcurrentStreams(t *testing.T) {
+	state := &connState{session: make(map[string]any)}
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.UpdateSession("requests", func(old any, _ bool) any {
+				count, _ := old.(int)
+				return count + 1
+			})
+		}()
+	}
+	wg.Wait()
+	if requests, _ := state.GetSession("requests"); requests != 50 {
+		t.Errorf("counted %v requests, want 50", requests)
+	}
+}
+
+func TestJitterDelaysResponses(t *testing.T) {
+	responseJitter, _ = parseJitter("100ms-150ms", 1)
+	responses = newResponseCache(8, time.Minute)
+	defer func() { responseJitter, responses = nil, nil }()
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+
+	// The second, identical, request is a cache hit and must be delayed too
+	hits := cacheHits.Value()
+	for i := range 2 {
+		start := time.Now()
+		if err := checkEcho(testContext(t), conn); err != nil {
+			t.Fatal(err)
+		}
+		// Allow a little on top for the round trip itself
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 250*time.Millisecond {
+			t.Errorf("response %d took %v, want 100ms-150ms of jitter", i+1, elapsed)
+		}
+	}
+	if got := cacheHits.Value() - hits; got != 1 {
+		t.Errorf("%d cache hits, want the repeated request served from the cache", got)
+	}
+}
+
+func TestRepeatedRequestServedFromCache(t *testing.T) {
+	responses = newResponseCache(8, time.Minute)
+	defer func() { responses = nil }()
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+
+	hits, misses := cacheHits.Value(), cacheMisses.Value()
+	for _, request := range []string{"same", "same", "other"} {
+		if err := expectEcho(ctx, conn, []byte(request)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := cacheHits.Value() - hits; got != 1 {
+		t.Errorf("%d cache hits, want 1 for the repeated request", got)
+	}
+	if got := cacheMisses.Value() - misses; got != 2 {
+		t.Errorf("%d cache misses, want 2 for the distinct requests", got)
+	}
+}
+
+func TestNumberedLines(t *testing.T) {
+	setFlag(t, "number-lines", "true")
+	setFlag(t, "max-buffer", "64")
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+
+	// A line of exactly -max-buffer bytes, newline included, still fits
+	atLimit := strings.Repeat("x", 63) + "\n"
+	got, err := roundTrip(ctx, conn, []byte("first\n"+atLimit+"\nlast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%6d\t%s%6d\t%s%6d\t%s%6d\t%s", 1, "first\n", 2, atLimit, 3, "\n", 4, "last")
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Every stream counts from 1 again
+	if got, err := roundTrip(ctx, conn, []byte("again\n")); err != nil || string(got) != "     1\tagain\n" {
+		t.Errorf("second stream: got %q, %v, want its line numbered 1", got, err)
+	}
+
+	// One byte more and the line is refused
+	_, err = roundTrip(ctx, conn, []byte("x"+atLimit))
+	wantStreamReset(t, err, errorCodePayloadTooLarge)
+}
+
+func TestConnRateRefusesBeyondBurst(t *testing.T) {
+	// Nothing refills during the test, so only the burst gets in
+	connRate = newConnRateLimiter(0.1, 2, 0)
+	defer func() { connRate = nil }()
+	addr := startServer(t, nil, 0)
+
+	admitted := []*quic.Conn{dialServer(t, addr, nil, nil), dialServer(t, addr, nil, nil)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpnProtocol}}, nil)
+	if err == nil {
+		conn.CloseWithError(0, "")
+		t.Fatal("the connection beyond the burst was let in")
+	}
+	// The refusal is the server's, during the handshake
+	var transportErr *quic.TransportError
+	if !errors.As(err, &transportErr) || !transportErr.Remote {
+		t.Errorf("the connection beyond the burst failed with %v, want the server to refuse it", err)
+	}
+	for i, conn := range admitted {
+		if err := checkEcho(ctx, conn); err != nil {
+			t.Errorf("admitted connection %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestConnPriority(t *testing.T) {
+	highPriorityNames = map[string]bool{"premium": true, "ops-console": true}
+	defer func() { highPriorityNames = nil }()
+	tests := []struct {
+		name    string
+		subject pkix.Name
+		want    priorityClass
+	}{
+		{"listed organizational unit", pkix.Name{CommonName: "tenant-a", OrganizationalUnit: []string{"staff", "premium"}}, priorityHigh},
+		{"listed common name", pkix.Name{CommonName: "ops-console"}, priorityHigh},
+		{"unlisted", pkix.Name{CommonName: "tenant-b", OrganizationalUnit: []string{"basic"}}, priorityLow},
+	}
+	for _, tt := range tests {
+		if got := connPriority([]*x509.Certificate{{Subject: tt.subject}}); got != tt.want {
+			t.Errorf("%s: connPriority() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := connPriority(nil); got != priorityLow {
+		t.Errorf("without a certificate: connPriority() = %v, want %v", got, priorityLow)
+	}
+}
+
+// Under overload, a high-priority newcomer sheds the newest low-priority
+// connection, while low-priority newcomers are refused once no connection
+// below them is left
+func TestShedVictim(t *testing.T) {
+	now := time.Now()
+	oldLow := &connState{priority: priorityLow, opened: now.Add(-time.Minute)}
+	newLow := &connState{priority: priorityLow, opened: now}
+	high := &connState{priority: priorityHigh, opened: now.Add(-time.Hour)}
+	open := map[*connState]struct{}{oldLow: {}, newLow: {}, high: {}}
+
+	if got := shedVictim(open, &connState{priority: priorityHigh}); got != newLow {
+		t.Errorf("high newcomer shed %p, want the newest low-priority connection %p", got, newLow)
+	}
+	delete(open, newLow)
+	if got := shedVictim(open, &connState{priority: priorityHigh}); got != oldLow {
+		t.Errorf("high newcomer shed %p, want the remaining low-priority connection %p", got, oldLow)
+	}
+	if got := shedVictim(open, &connState{priority: priorityLow}); got != nil {
+		t.Errorf("low newcomer shed %p, want it refused", got)
+	}
+	delete(open, oldLow)
+	if got := shedVictim(open, &connState{priority: priorityHigh}); got != nil {
+		t.Errorf("high newcomer among high-priority connections shed %p, want it refused", got)
+	}
+}
+
+func TestShedUnderMaxConns(t *testing.T) {
+	setFlag(t, "max-conns", "1")
+	highPriorityNames = map[string]bool{"premium": true}
+	defer func() { highPriorityNames = nil }()
+
+	ca, caKey := testCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tlsConf := generateTLSConfig()
+	if err := requireClientCerts(tlsConf, caFile); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, tlsConf, 0)
+	dialAs := func(commonName string) *quic.Conn {
+		return dialServer(t, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{alpnProtocol},
+			Certificates:       []tls.Certificate{issueClientCert(t, ca, caKey, commonName)},
+		}, nil)
+	}
+
+	low := dialAs("tenant-a")
+	if err := checkEcho(testContext(t), low); err != nil {
+		t.Fatal(err)
+	}
+	// The server is full, and the newcomer outranks nobody
+	wantClosedWith(t, dialAs("tenant-b"), 2*time.Second, errorCodeShed, closeReasonFull)
+	if err := checkEcho(testContext(t), low); err != nil {
+		t.Fatalf("the admitted connection after a refusal: %v", err)
+	}
+
+	// A high-priority newcomer takes the low-priority connection's place
+	high := dialAs("premium")
+	wantClosedWith(t, low, 2*time.Second, errorCodeShed, closeReasonShed)
+	if err := checkEcho(testContext(t), high); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testCA returns a self-signed CA certificate and its key
+func testCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// issueClientCert returns a client certificate for commonName signed by ca
+func issueClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestVersionNegotiationLogged(t *testing.T) {
+	udpConn, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	transport := newTransport(udpConn)
+	defer transport.Close()
+	// Catch the call so its log line can be checked on the test's goroutine
+	type negotiation struct {
+		dest     net.Addr
+		versions []logging.Version
+	}
+	negotiations := make(chan negotiation, 1)
+	logNegotiation := transport.Tracer.SentVersionNegotiationPacket
+	transport.Tracer.SentVersionNegotiationPacket = func(dest net.Addr, _, _ logging.ArbitraryLenConnectionID, versions []logging.Version) {
+		negotiations <- negotiation{dest, versions}
+	}
+	listener, err := transport.Listen(generateTLSConfig(), &quic.Config{Versions: []quic.Version{quic.Version1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go acceptConnections(listener, 0)
+
+	// The client starts with v2, which this server doesn't speak
+	conn := dialServer(t, listener.Addr().String(), nil, &quic.Config{Versions: []quic.Version{quic.Version2, quic.Version1}})
+	if got := conn.ConnectionState().Version; got != quic.Version1 {
+		t.Errorf("negotiated %v, want v1", got)
+	}
+	var sent negotiation
+	select {
+	case sent = <-negotiations:
+	default:
+		t.Fatal("no version negotiation packet was sent")
+	}
+	if !slices.Equal(sent.versions, []logging.Version{quic.Version1}) {
+		t.Errorf("offered %v, want v1", sent.versions)
+	}
+	if got, want := sent.dest.(*net.UDPAddr).Port, conn.LocalAddr().(*net.UDPAddr).Port; got != want {
+		t.Errorf("sent the version negotiation to port %d, want the client's %d", got, want)
+	}
+	output := captureOutput(t, func() { logNegotiation(sent.dest, nil, nil, sent.versions) })
+	if want := fmt.Sprintf("Client %s requested an unsupported version, sent version negotiation offering [v1]", sent.dest); !strings.Contains(output, want) {
+		t.Errorf("logged %q, want it to include %q", output, want)
+	}
+}
+
+// captureOutput returns what f prints to stdout
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+func TestHandshakeDurationHistogram(t *testing.T) {
+	type snapshot struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Sum     float64           `json:"sum"`
+		Count   uint64            `json:"count"`
+	}
+	// Read it the way /debug/vars serves it
+	read := func() snapshot {
+		var s snapshot
+		if err := json.Unmarshal([]byte(expvar.Get("handshake_duration_seconds").String()), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	before := read()
+	dialServer(t, startServer(t, nil, 0), nil, nil)
+
+	// The server records the handshake once Accept hands it the connection
+	if !waitFor(time.Second, func() bool { return read().Count == before.Count+1 }) {
+		t.Fatalf("histogram counts %d handshakes, want %d", read().Count, before.Count+1)
+	}
+	after := read()
+	if after.Sum <= before.Sum {
+		t.Errorf("sum went from %v to %v, want a positive duration added", before.Sum, after.Sum)
+	}
+	if after.Buckets["+Inf"] != before.Buckets["+Inf"]+1 {
+		t.Errorf("+Inf bucket went from %d to %d, want every observation counted in it", before.Buckets["+Inf"], after.Buckets["+Inf"])
+	}
+}
+
+func TestLargeEchoInSmallPackets(t *testing.T) {
+	setFlag(t, "initial-packet-size", "1200")
+	setFlag(t, "disable-mtu-discovery", "true")
+	addr := startServer(t, nil, 0)
+
+	// The client keeps the defaults, so only the server's packets are small
+	var packets, largest atomic.Int64
+	conn := dialServer(t, addr, nil, &quic.Config{
+		Tracer: func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+			return &logging.ConnectionTracer{
+				ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+					packets.Add(1)
+					if int64(size) > largest.Load() {
+						largest.Store(int64(size))
+					}
+				},
+			}
+		},
+	})
+	if err := checkLargeEcho(testContext(t), conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := largest.Load(); got > 1200 {
+		t.Errorf("received a %d-byte packet, want none over the server's 1200", got)
+	}
+	if got, want := packets.Load(), int64(*maxBuffer/1200); got < want {
+		t.Errorf("the echo came in %d packets, want at least %d", got, want)
+	}
+}
+
+func TestLogsClientCloseReason(t *testing.T) {
+	// Everything that prints runs inside the capture and is done before it ends
+	output := captureOutput(t, func() {
+		conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+		onlyConn(t)
+		conn.CloseWithError(0, "client done")
+		if remaining := waitForDisconnects(time.Second); remaining > 0 {
+			t.Errorf("%d connections still open after the client left", remaining)
+		}
+	})
+	if want := `closed the connection: "client done" (code 0)`; !strings.Contains(output, want) {
+		t.Errorf("logged %q, want it to include %q", output, want)
+	}
+}
+
+func TestOverheadCounts(t *testing.T) {
+	setFlag(t, "overhead", "true")
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	request := bytes.Repeat([]byte("q"), 32*1024)
+	if err := expectEcho(testContext(t), conn, request); err != nil {
+		t.Fatal(err)
+	}
+	wire := onlyConn(t).wire
+	if wire == nil {
+		t.Fatal("no wire stats with -overhead")
+	}
+
+	received, sent := wire.payloadReceived.Load(), wire.payloadSent.Load()
+	if received != int64(len(request)) || sent != int64(len("Echo: ")+len(request)) {
+		t.Errorf("counted %d payload bytes received and %d sent, want the request's %d and the echo's %d", received, sent, len(request), len("Echo: ")+len(request))
+	}
+	// Headers, frames, encryption and the handshake come on top, but for
+	// this much payload they shouldn't add up to half of it again
+	payload := float64(received + sent)
+	ratio := float64(wire.wireReceived.Load()+wire.wireSent.Load()) / payload
+	if ratio <= 1 || ratio > 1.5 {
+		t.Errorf("%d bytes on the wire for %v of payload, a %.2fx overhead, want somewhat over 1x", wire.wireReceived.Load()+wire.wireSent.Load(), payload, ratio)
+	}
+	if wire.wireReceived.Load() <= received || wire.wireSent.Load() <= sent {
+		t.Errorf("on the wire %d received and %d sent, want more than the payload in each direction", wire.wireReceived.Load(), wire.wireSent.Load())
+	}
+	var report strings.Builder
+	wire.report(&report, conn.LocalAddr())
+	output := report.String()
+	for _, want := range []string{fmt.Sprintf("for %d payload bytes", received+sent), "x overhead"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("reported %q, want it to include %q", output, want)
+		}
+	}
+}
+
+func TestClientLeavesBeforeEcho(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		jitter string
+	}{
+		{"as the response is sent", ""},
+		{"while the response is delayed", "200ms-200ms"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.jitter != "" {
+				responseJitter, _ = parseJitter(tt.jitter, 1)
+				defer func() { responseJitter = nil }()
+			}
+			conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+			state := onlyConn(t)
+			stream, err := conn.OpenStreamSync(testContext(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.Write([]byte("hello"))
+			stream.Close()
+			// Leave once the server has the request, with the response on its
+			// way or, with jitter, still held back
+			if !waitFor(time.Second, func() bool { requests, _ := state.GetSession("requests"); return requests == 1 }) {
+				t.Fatal("the server never got the request")
+			}
+			conn.CloseWithError(0, "client done")
+			if remaining := waitForDisconnects(time.Second); remaining > 0 {
+				t.Fatalf("%d connections still open after the client left", remaining)
+			}
+
+			// The handler finishes without a word about it
+			done := make(chan struct{})
+			go func() {
+				inflight.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("the stream handler is still running after the client left")
+			}
+			if logged := state.errorsLogged.Load(); logged > 0 {
+				t.Errorf("logged %d errors for a client leaving, want none", logged)
+			}
+		})
+	}
+}
+
+func TestMalformedInitialsAreCounted(t *testing.T) {
+	addr := startServer(t, nil, 0)
+	counter := func(m *expvar.Map, name string) int64 {
+		if v, ok := m.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	// An initial that parses as QUIC v1 but whose payload is garbage
+	before := counter(droppedPackets, "payload_decrypt_error")
+	udp, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	packet := make([]byte, 1200)
+	rand.Read(packet)
+	header := []byte{0xc0, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8, 8, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	header = quicvarint.Append(header, uint64(len(packet)-len(header)-2))
+	copy(packet, header)
+	if _, err := udp.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second, func() bool { return counter(droppedPackets, "payload_decrypt_error") > before }) {
+		t.Error("the malformed initial wasn't counted as a dropped packet")
+	}
+
+	// A client the handshake fails for is an abort quic-go raised itself
+	before = counter(handshakeAborts, "CRYPTO_ERROR")
+	ctx := testContext(t)
+	if conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"not-ours"}}, nil); err == nil {
+		conn.CloseWithError(0, "")
+		t.Fatal("the handshake succeeded without a common ALPN protocol")
+	}
+	if !waitFor(time.Second, func() bool { return counter(handshakeAborts, "CRYPTO_ERROR") > before }) {
+		t.Error("the failed handshake wasn't counted as an abort")
+	}
+
+	// Neither got in the way of a well-behaved client
+	if err := checkEcho(ctx, dialServer(t, addr, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnIDLength(t *testing.T) {
+	for _, length := range []int{1, 20} {
+		t.Run(fmt.Sprint(length), func(t *testing.T) {
+			setFlag(t, "conn-id-length", fmt.Sprint(length))
+			addr := startServer(t, nil, 0)
+
+			// Once the handshake is done, the client addresses the server by an ID it issued
+			var lengths sync.Map
+			conn := dialServer(t, addr, nil, &quic.Config{
+				Tracer: func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+					return &logging.ConnectionTracer{
+						SentShortHeaderPacket: func(hdr *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+							lengths.Store(hdr.DestConnectionID.Len(), true)
+						},
+					}
+				},
+			})
+			if err := checkLargeEcho(testContext(t), conn); err != nil {
+				t.Fatal(err)
+			}
+			lengths.Range(func(got, _ any) bool {
+				if got != length {
+					t.Errorf("client sent to a %d-byte connection ID, want %d", got, length)
+				}
+				return true
+			})
+			if _, ok := lengths.Load(length); !ok {
+				t.Errorf("client never sent to a %d-byte connection ID", length)
+			}
+		})
+	}
+}
+
+func TestSimultaneousClose(t *testing.T) {
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	state := onlyConn(t)
+	ctx := testContext(t)
+
+	// Both sides close their half as soon as they're done writing, over and
+	// over, and some clients abandon the stream the moment the echo arrives
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				errs <- expectEcho(ctx, conn, []byte("hello"))
+				return
+			}
+			stream, err := conn.OpenStreamSync(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			stream.Write([]byte("hello"))
+			stream.Close()
+			buf := make([]byte, 1)
+			if _, err := stream.Read(buf); err != nil {
+				errs <- err
+				return
+			}
+			stream.CancelRead(0)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stream handlers still running after every stream ended")
+	}
+	if logged := state.errorsLogged.Load(); logged > 0 {
+		t.Errorf("logged %d errors for streams both sides closed normally, want none", logged)
+	}
+	if err := checkEcho(ctx, conn); err != nil {
+		t.Errorf("after the closes: %v", err)
+	}
+}
+
+func TestNodelayCoalescesSmallWrites(t *testing.T) {
+	setFlag(t, "number-lines", "true")
+	addr := startServer(t, nil, 0)
+	const lines = 100
+
+	// numberLines sends a line every millisecond and returns how many
+	// packets the server's numbered copy of them arrived in
+	numberLines := func(t *testing.T) int64 {
+		var packets atomic.Int64
+		conn := dialServer(t, addr, nil, &quic.Config{
+			Tracer: func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+				return &logging.ConnectionTracer{
+					ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+						if slices.ContainsFunc(frames, func(f logging.Frame) bool { _, ok := f.(*logging.StreamFrame); return ok }) {
+							packets.Add(1)
+						}
+					},
+				}
+			},
+		})
+		stream, err := conn.OpenStreamSync(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for i := range lines {
+				fmt.Fprintf(stream, "line %d\n", i+1)
+				time.Sleep(time.Millisecond)
+			}
+			stream.Close()
+		}()
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		response, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want strings.Builder
+		for i := range lines {
+			fmt.Fprintf(&want, "%6d\tline %d\n", i+1, i+1)
+		}
+		if string(response) != want.String() {
+			t.Fatalf("got %d bytes of numbered lines, want all %d lines in order", len(response), lines)
+		}
+		return packets.Load()
+	}
+
+	immediate := numberLines(t)
+	setFlag(t, "nodelay", "false")
+	coalesced := numberLines(t)
+	if coalesced*2 > immediate {
+		t.Errorf("%d lines came in %d packets with -nodelay=false and %d with -nodelay, want under half as many", lines, coalesced, immediate)
+	}
+}
+
+func TestAcceptLoopExitsOnClose(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for _, closing := range []string{"listener", "transport"} {
+		t.Run(closing, func(t *testing.T) {
+			// Runs after the client hangs up, so the next test doesn't find
+			// this connection or its handler still printing
+			t.Cleanup(func() { waitForDisconnects(time.Second) })
+			udpConn, err := listenUDP("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer udpConn.Close()
+			transport := newTransport(udpConn)
+			defer transport.Close()
+			listener, err := transport.Listen(generateTLSConfig(), &quic.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			done := make(chan struct{})
+			go func() {
+				acceptConnections(listener, 0)
+				close(done)
+			}()
+			// Let it block in Accept first
+			if err := checkEcho(testContext(t), dialServer(t, listener.Addr().String(), nil, nil)); err != nil {
+				t.Fatal(err)
+			}
+
+			if closing == "listener" {
+				listener.Close()
+			} else {
+				transport.Close()
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("the accept loop still runs after the %s closed", closing)
+			}
+		})
+	}
+	if logged.Len() > 0 {
+		t.Errorf("logged %q, want closing to be a clean exit", logged.String())
+	}
+}
+
+func TestUnknownALPNRefused(t *testing.T) {
+	// What the server logs for such a ClientHello. Checked before any
+	// connection exists, so nothing else prints during the capture.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	output := captureOutput(t, func() {
+		if conf, err := getConfigForClient(&tls.ClientHelloInfo{Conn: server, SupportedProtos: []string{"h3", "not-ours"}}); conf != nil || err != nil {
+			t.Errorf("getConfigForClient() = %v, %v, want crypto/tls left to refuse it", conf, err)
+		}
+	})
+	if want := fmt.Sprintf("offered ALPN protocols %q, but we only speak %q", []string{"h3", "not-ours"}, serverALPN()); !strings.Contains(output, want) {
+		t.Errorf("logged %q, want it to include %q", output, want)
+	}
+
+	addr := startServer(t, nil, 0)
+	ctx := testContext(t)
+	_, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3", "not-ours"}}, nil)
+	var transportErr *quic.TransportError
+	if !errors.As(err, &transportErr) || !transportErr.Remote || transportErr.ErrorCode != quic.TransportErrorCode(0x100+120) {
+		t.Fatalf("got %v, want the server's no_application_protocol alert", err)
+	}
+}
+
+func TestCannedResponse(t *testing.T) {
+	canned = bytes.Repeat([]byte("canned "), 2000)
+	defer func() { canned = nil }()
+	conn := dialServer(t, startServer(t, nil, 0), nil, nil)
+	ctx := testContext(t)
+
+	large := make([]byte, *maxBuffer)
+	rand.Read(large)
+	for _, request := range [][]byte{nil, []byte("hello"), {0, 0xff, '\n'}, large} {
+		got, err := roundTrip(ctx, conn, request)
+		if err != nil {
+			t.Fatalf("%d-byte request: %v", len(request), err)
+		}
+		if !bytes.Equal(got, canned) {
+			t.Errorf("%d-byte request got %d bytes back, want the %d-byte canned response", len(request), len(got), len(canned))
+		}
+	}
+
+	// The request is still read in full, so its size is still limited
+	_, err := roundTrip(ctx, conn, append(large, 'q'))
+	wantStreamReset(t, err, errorCodePayloadTooLarge)
+}
+
+func TestConnectionWindowBackpressure(t *testing.T) {
+	setFlag(t, "max-buffer", fmt.Sprint(256*1024))
+	// Only for the flow control metrics; the tests don't serve them
+	setFlag(t, "metrics-addr", "127.0.0.1:0")
+	addr := startServer(t, nil, 0)
+
+	// Each stream may take all of its echo, the connection only a fraction of one
+	conn := dialServer(t, addr, nil, &quic.Config{
+		InitialStreamReceiveWindow:     512 * 1024,
+		MaxStreamReceiveWindow:         512 * 1024,
+		InitialConnectionReceiveWindow: 64 * 1024,
+		MaxConnectionReceiveWindow:     64 * 1024,
+	})
+	blocked := func() int64 {
+		if v, ok := flowBlocked.Get("connection").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := blocked()
+
+	ctx := testContext(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := bytes.Repeat([]byte{byte('a' + i)}, *maxBuffer)
+			stream, err := conn.OpenStreamSync(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := stream.Write(request); err != nil {
+				errs <- err
+				return
+			}
+			stream.Close()
+			// Let every response pile up against the connection window first
+			time.Sleep(200 * time.Millisecond)
+			stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			response, err := io.ReadAll(stream)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if want := append([]byte("Echo: "), request...); !bytes.Equal(response, want) {
+				errs <- fmt.Errorf("stream %d: got %d bytes back, want its %d-byte echo", stream.StreamID(), len(response), len(want))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if blocked() == before {
+		t.Error("the server was never blocked by the connection window, so it wasn't saturated")
+	}
+}
+
+func TestPrintDiagnostics(t *testing.T) {
+	responseJitter, _ = parseJitter("300ms-300ms", 1)
+	defer func() { responseJitter = nil }()
+	addr := startServer(t, nil, 0)
+	busy := dialServer(t, addr, nil, nil)
+	idle := dialServer(t, addr, nil, nil)
+
+	// Hold a stream in flight on one of them
+	echoed := make(chan error, 1)
+	go func() { echoed <- checkEcho(testContext(t), busy) }()
+	inFlight := func() int32 {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+		var streams int32
+		for state := range conns {
+			streams += state.streams.Load()
+		}
+		return streams
+	}
+	if !waitFor(time.Second, func() bool { return inFlight() == 1 }) {
+		t.Fatal("the stream never got to the handler")
+	}
+
+	var dump strings.Builder
+	printDiagnostics(&dump)
+	for _, want := range []string{
+		"2 connections, 1 streams in flight, ",
+		fmt.Sprintf("127.0.0.1:%d: 1 streams", busy.LocalAddr().(*net.UDPAddr).Port),
+		fmt.Sprintf("127.0.0.1:%d: 0 streams", idle.LocalAddr().(*net.UDPAddr).Port),
+	} {
+		if !strings.Contains(dump.String(), want) {
+			t.Errorf("dump doesn't include %q:\n%s", want, dump.String())
+		}
+	}
+	if strings.Contains(dump.String(), "goroutine profile") {
+		t.Error("dumped stacks without -dump-stacks")
+	}
+
+	setFlag(t, "dump-stacks", "true")
+	dump.Reset()
+	printDiagnostics(&dump)
+	if !strings.Contains(dump.String(), "goroutine profile: total") || !strings.Contains(dump.String(), "handleStream") {
+		t.Errorf("dump with -dump-stacks doesn't show the stream handler's stack:\n%s", dump.String())
+	}
+	if err := <-echoed; err != nil {
+		t.Error(err)
+	}
+}